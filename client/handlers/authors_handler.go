@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	pb "gc-buku/proto"
+
+	"github.com/labstack/echo/v4"
+)
+
+type AuthorsHandler struct {
+	grpcClient pb.BookServiceClient
+}
+
+func NewAuthorsHandler(client pb.BookServiceClient) *AuthorsHandler {
+	return &AuthorsHandler{grpcClient: client}
+}
+
+func (h *AuthorsHandler) CreateAuthor(c echo.Context) error {
+	type CreateAuthorRequest struct {
+		Name    string   `json:"name"`
+		Aliases []string `json:"aliases"`
+		Bio     string   `json:"bio"`
+	}
+	req := new(CreateAuthorRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.CreateAuthor(ctx, &pb.CreateAuthorRequest{
+		Author: &pb.Author{
+			Name:    req.Name,
+			Aliases: req.Aliases,
+			Bio:     req.Bio,
+		},
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, resp.Author)
+}
+
+func (h *AuthorsHandler) GetAuthor(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.GetAuthor(ctx, &pb.GetAuthorRequest{Id: c.Param("id")})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp.Author)
+}
+
+func (h *AuthorsHandler) ListAuthors(c echo.Context) error {
+	req := &pb.ListAuthorsRequest{
+		Query:     c.QueryParam("q"),
+		PageToken: c.QueryParam("page_token"),
+	}
+	if v := c.QueryParam("page_size"); v != "" {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid page_size"})
+		}
+		req.PageSize = int32(pageSize)
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListAuthors(ctx, req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"authors":         resp.Authors,
+		"next_page_token": resp.NextPageToken,
+	})
+}
+
+// AuthorBooks lists the books crediting an author, in any role.
+func (h *AuthorsHandler) AuthorBooks(c echo.Context) error {
+	req := &pb.ListBooksRequest{
+		AuthorId:   c.Param("id"),
+		PageToken:  c.QueryParam("page_token"),
+		SortBy:     c.QueryParam("sort_by"),
+		Descending: c.QueryParam("order") == "desc",
+	}
+	if v := c.QueryParam("page_size"); v != "" {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid page_size"})
+		}
+		req.PageSize = int32(pageSize)
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListBooks(ctx, req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"books":           resp.Books,
+		"next_page_token": resp.NextPageToken,
+	})
+}
+
+// MergeAuthors merges the authors in source_ids into the author in the path.
+func (h *AuthorsHandler) MergeAuthors(c echo.Context) error {
+	type MergeAuthorsRequest struct {
+		SourceIDs []string `json:"source_ids"`
+	}
+	req := new(MergeAuthorsRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.MergeAuthors(ctx, &pb.MergeAuthorsRequest{
+		TargetId:  c.Param("id"),
+		SourceIds: req.SourceIDs,
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"author":        resp.Author,
+		"books_updated": resp.BooksUpdated,
+	})
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "gc-buku/proto"
+
+	"github.com/labstack/echo/v4"
+)
+
+// exportTimeout bounds a catalog export.
+const exportTimeout = 10 * time.Minute
+
+// exportColumns are the CSV columns of an export: those the import reads,
+// so that an export can be imported again, then the book's ID, status and
+// copy counts.
+var exportColumns = []string{
+	"external_id", "title", "author", "isbn", "description", "published_date", "category",
+	"subjects", "tags", "dewey", "lcc", "id", "status", "total_copies", "available_copies",
+}
+
+// exportedBook is a book as exported to JSON Lines, with the keys of
+// exportColumns and the book's contributors.
+type exportedBook struct {
+	ExternalID      string                `json:"external_id,omitempty"`
+	Title           string                `json:"title"`
+	Author          string                `json:"author"`
+	Contributors    []exportedContributor `json:"contributors"`
+	ISBN            string                `json:"isbn,omitempty"`
+	Description     string                `json:"description,omitempty"`
+	PublishedDate   string                `json:"published_date"`
+	Category        string                `json:"category,omitempty"`
+	Subjects        []string              `json:"subjects"`
+	Tags            []string              `json:"tags"`
+	Dewey           string                `json:"dewey,omitempty"`
+	LCC             string                `json:"lcc,omitempty"`
+	ID              string                `json:"id"`
+	Status          string                `json:"status"`
+	TotalCopies     int32                 `json:"total_copies"`
+	AvailableCopies int32                 `json:"available_copies"`
+}
+
+type exportedContributor struct {
+	AuthorID string `json:"author_id"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+}
+
+func newExportedBook(resp *pb.ExportBooksResponse) exportedBook {
+	book := resp.Book
+	exported := exportedBook{
+		ExternalID:      book.ExternalId,
+		Title:           book.Title,
+		Author:          book.Author,
+		Contributors:    []exportedContributor{},
+		ISBN:            book.Isbn_13,
+		Description:     book.Description,
+		PublishedDate:   book.PublishedDate,
+		Category:        book.Category,
+		Subjects:        resp.Subjects,
+		Tags:            book.Tags,
+		Dewey:           book.Dewey,
+		LCC:             book.Lcc,
+		ID:              book.Id,
+		Status:          book.Status,
+		TotalCopies:     book.TotalCopies,
+		AvailableCopies: book.AvailableCopies,
+	}
+	for _, c := range book.Contributors {
+		exported.Contributors = append(exported.Contributors, exportedContributor{AuthorID: c.AuthorId, Name: c.Name, Role: c.Role})
+	}
+	if exported.Subjects == nil {
+		exported.Subjects = []string{}
+	}
+	if exported.Tags == nil {
+		exported.Tags = []string{}
+	}
+	return exported
+}
+
+// csvRecord returns the book's values in the order of exportColumns, with
+// lists separated by semicolons.
+func (b exportedBook) csvRecord() []string {
+	return []string{
+		b.ExternalID, b.Title, b.Author, b.ISBN, b.Description, b.PublishedDate, b.Category,
+		strings.Join(b.Subjects, ";"), strings.Join(b.Tags, ";"), b.Dewey, b.LCC,
+		b.ID, b.Status, strconv.Itoa(int(b.TotalCopies)), strconv.Itoa(int(b.AvailableCopies)),
+	}
+}
+
+// ExportBooks downloads the whole catalog in the format given by the
+// "format" query parameter: csv, jsonl, marc21 or marcxml. The file is
+// streamed as the server reads the catalog, never held in memory.
+func (h *BookHandler) ExportBooks(c echo.Context) error {
+	ctx, cancel := grpcContextWithTimeout(c, exportTimeout)
+	defer cancel()
+
+	format := c.QueryParam("format")
+	switch format {
+	case "csv", "jsonl":
+	case "marc21", "marcxml":
+		stream, err := h.grpcClient.ExportMARC(ctx, &pb.ExportMARCRequest{Format: format})
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		contentType, filename := "application/marc", "books.mrc"
+		if format == "marcxml" {
+			contentType, filename = "application/marcxml+xml", "books.xml"
+		}
+		return download(c, contentType, filename, stream.Recv, func(w io.Writer) (func(*pb.ExportMARCResponse) error, func() error) {
+			write := func(chunk *pb.ExportMARCResponse) error {
+				_, err := w.Write(chunk.Data)
+				return err
+			}
+			return write, func() error { return nil }
+		})
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be csv, jsonl, marc21 or marcxml"})
+	}
+
+	stream, err := h.grpcClient.ExportBooks(ctx, &pb.ExportBooksRequest{})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if format == "jsonl" {
+		return download(c, "application/x-ndjson", "books.jsonl", stream.Recv, func(w io.Writer) (func(*pb.ExportBooksResponse) error, func() error) {
+			enc := json.NewEncoder(w)
+			enc.SetEscapeHTML(false)
+			write := func(resp *pb.ExportBooksResponse) error {
+				return enc.Encode(newExportedBook(resp))
+			}
+			return write, func() error { return nil }
+		})
+	}
+	return download(c, "text/csv", "books.csv", stream.Recv, func(w io.Writer) (func(*pb.ExportBooksResponse) error, func() error) {
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		write := func(resp *pb.ExportBooksResponse) error {
+			return cw.Write(newExportedBook(resp).csvRecord())
+		}
+		end := func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		return write, end
+	})
+}
+
+// download responds with a file attachment, writing each message recv
+// returns with the writer newWriter makes. The first message is awaited
+// before responding so that an error can still be reported as such. Once
+// the file has started, a failure aborts the response, so that the client
+// sees the download fail rather than end early.
+func download[T any](c echo.Context, contentType, filename string, recv func() (T, error), newWriter func(io.Writer) (write func(T) error, end func() error)) error {
+	msg, err := recv()
+	if err != nil && err != io.EOF {
+		return errorResponse(c, err)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, contentType)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	res.WriteHeader(http.StatusOK)
+
+	write, end := newWriter(res)
+	for ; err == nil; msg, err = recv() {
+		// A failed write means the client has gone away.
+		if write(msg) != nil {
+			return nil
+		}
+	}
+	if err != io.EOF {
+		log.Printf("Export to %s failed: %v", filename, err)
+		panic(http.ErrAbortHandler)
+	}
+	// As with a failed write, there is no one left to tell if this fails.
+	end()
+	return nil
+}
@@ -1,8 +1,11 @@
 package handlers
 
 import (
-	"context"
+	"io"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	pb "gc-buku/proto"
@@ -10,6 +13,20 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	// importTimeout bounds a catalog import, which runs row by row.
+	importTimeout = 10 * time.Minute
+	// importChunkSize is how much of an uploaded file each import message
+	// carries.
+	importChunkSize = 64 * 1024
+)
+
+// ContributorRequest credits an author on a book in a create or update.
+type ContributorRequest struct {
+	AuthorID string `json:"author_id"`
+	Role     string `json:"role"`
+}
+
 type BookHandler struct {
 	grpcClient pb.BookServiceClient
 }
@@ -19,35 +36,182 @@ func NewBookHandler(client pb.BookServiceClient) *BookHandler {
 }
 
 func (h *BookHandler) CreateBook(c echo.Context) error {
+	type CreateItemRequest struct {
+		Barcode   string `json:"barcode"`
+		Location  string `json:"location"`
+		Condition string `json:"condition"`
+	}
 	type CreateBookRequest struct {
-		Title         string `json:"title"`
-		Author        string `json:"author"`
-		PublishedDate string `json:"published_date"`
+		Title         string               `json:"title"`
+		Author        string               `json:"author"`
+		Contributors  []ContributorRequest `json:"contributors"`
+		ISBN13        string               `json:"isbn_13"`
+		ISBN10        string               `json:"isbn_10"`
+		ExternalID    string               `json:"external_id"`
+		Description   string               `json:"description"`
+		PublishedDate string               `json:"published_date"`
+		Category      string               `json:"category"`
+		SubjectIDs    []string             `json:"subject_ids"`
+		Tags          []string             `json:"tags"`
+		Dewey         string               `json:"dewey"`
+		LCC           string               `json:"lcc"`
+		Items         []CreateItemRequest  `json:"items"`
 	}
 	req := new(CreateBookRequest)
 	if err := c.Bind(req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
+	items := make([]*pb.Item, 0, len(req.Items))
+	for _, item := range req.Items {
+		items = append(items, &pb.Item{
+			Barcode:   item.Barcode,
+			Location:  item.Location,
+			Condition: item.Condition,
+		})
+	}
+
 	resp, err := h.grpcClient.CreateBook(ctx, &pb.CreateBookRequest{
 		Book: &pb.Book{
 			Title:         req.Title,
 			Author:        req.Author,
+			Contributors:  contributorsToProto(req.Contributors),
+			Isbn_13:       req.ISBN13,
+			Isbn_10:       req.ISBN10,
+			ExternalId:    req.ExternalID,
+			Description:   req.Description,
 			PublishedDate: req.PublishedDate,
+			Category:      req.Category,
+			SubjectIds:    req.SubjectIDs,
+			Tags:          req.Tags,
+			Dewey:         req.Dewey,
+			Lcc:           req.LCC,
 		},
+		Items: items,
 	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return errorResponse(c, err)
 	}
 
 	return c.JSON(http.StatusCreated, resp.Book)
 }
 
+// ImportBooks imports the CSV, JSON Lines, MARC21 or MARCXML catalog
+// uploaded as the "file" form field and responds with a result for each
+// row or record. The format is taken from the "format" field or else the
+// file extension.
+func (h *BookHandler) ImportBooks(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "missing file"})
+	}
+
+	format := c.FormValue("format")
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(file.Filename)) {
+		case ".csv":
+			format = "csv"
+		case ".jsonl", ".ndjson":
+			format = "jsonl"
+		case ".mrc", ".marc":
+			format = "marc21"
+		case ".xml":
+			format = "marcxml"
+		default:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be csv, jsonl, marc21 or marcxml"})
+		}
+	}
+	skipExisting := c.FormValue("skip_existing") == "true"
+
+	src, err := file.Open()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	defer src.Close()
+
+	ctx, cancel := grpcContextWithTimeout(c, importTimeout)
+	defer cancel()
+
+	// MARC files go to ImportMARC; everything else to ImportBooks, which
+	// rejects formats it does not know. The first message carries the
+	// options.
+	var send func(data []byte, first bool) error
+	var closeAndRecv func() (*pb.ImportBooksResponse, error)
+	switch format {
+	case "marc21", "marcxml":
+		stream, err := h.grpcClient.ImportMARC(ctx)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		send = func(data []byte, first bool) error {
+			req := &pb.ImportMARCRequest{Data: data}
+			if first {
+				req.Format, req.SkipExisting = format, skipExisting
+			}
+			return stream.Send(req)
+		}
+		closeAndRecv = stream.CloseAndRecv
+	default:
+		stream, err := h.grpcClient.ImportBooks(ctx)
+		if err != nil {
+			return errorResponse(c, err)
+		}
+		send = func(data []byte, first bool) error {
+			req := &pb.ImportBooksRequest{Data: data}
+			if first {
+				req.Format, req.SkipExisting = format, skipExisting
+			}
+			return stream.Send(req)
+		}
+		closeAndRecv = stream.CloseAndRecv
+	}
+
+	if err := sendChunks(src, send); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	resp, err := closeAndRecv()
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"created": resp.Created,
+		"updated": resp.Updated,
+		"skipped": resp.Skipped,
+		"failed":  resp.Failed,
+		"results": resp.Results,
+	})
+}
+
+// sendChunks sends r in chunks of importChunkSize. The first chunk is sent
+// even for an empty file. A failed send stops early; the stream reports why
+// when it is closed.
+func sendChunks(r io.Reader, send func(data []byte, first bool) error) error {
+	buf := make([]byte, importChunkSize)
+	first := true
+	for {
+		n, err := r.Read(buf)
+		if n > 0 || (first && err == io.EOF) {
+			if send(buf[:n], first) != nil {
+				return nil
+			}
+			first = false
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (h *BookHandler) GetBook(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
 	resp, err := h.grpcClient.GetBook(ctx, &pb.GetBookRequest{Id: c.Param("id")})
@@ -58,12 +222,108 @@ func (h *BookHandler) GetBook(c echo.Context) error {
 	return c.JSON(http.StatusOK, resp.Book)
 }
 
+// GetBookByISBN finds a book by a scanned ISBN-10 or ISBN-13.
+func (h *BookHandler) GetBookByISBN(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.GetBookByISBN(ctx, &pb.GetBookByISBNRequest{Isbn: c.Param("isbn")})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp.Book)
+}
+
+func (h *BookHandler) ListBooks(c echo.Context) error {
+	req := &pb.ListBooksRequest{
+		PageToken:       c.QueryParam("page_token"),
+		Status:          c.QueryParam("status"),
+		Author:          c.QueryParam("author"),
+		AuthorId:        c.QueryParam("author_id"),
+		SubjectId:       c.QueryParam("subject_id"),
+		Tag:             c.QueryParam("tag"),
+		Category:        c.QueryParam("category"),
+		IncludeFacets:   c.QueryParam("facets") == "true",
+		PublishedAfter:  c.QueryParam("published_after"),
+		PublishedBefore: c.QueryParam("published_before"),
+		SortBy:          c.QueryParam("sort_by"),
+		Descending:      c.QueryParam("order") == "desc",
+	}
+
+	if v := c.QueryParam("page_size"); v != "" {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid page_size"})
+		}
+		req.PageSize = int32(pageSize)
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListBooks(ctx, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	body := map[string]interface{}{
+		"books":           resp.Books,
+		"next_page_token": resp.NextPageToken,
+	}
+	if req.IncludeFacets {
+		body["facets"] = resp.Facets
+	}
+	return c.JSON(http.StatusOK, body)
+}
+
+func (h *BookHandler) SearchBooks(c echo.Context) error {
+	req := &pb.SearchBooksRequest{
+		Query:         c.QueryParam("q"),
+		IncludeFacets: c.QueryParam("facets") == "true",
+	}
+	if req.Query == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "missing q parameter"})
+	}
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+		}
+		req.Limit = int32(limit)
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.SearchBooks(ctx, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	body := map[string]interface{}{"results": resp.Results}
+	if req.IncludeFacets {
+		body["facets"] = resp.Facets
+	}
+	return c.JSON(http.StatusOK, body)
+}
+
 func (h *BookHandler) UpdateBook(c echo.Context) error {
 	type UpdateBookRequest struct {
-		Title         string `json:"title"`
-		Author        string `json:"author"`
-		PublishedDate string `json:"published_date"`
-		Status        string `json:"status"`
+		Title         string               `json:"title"`
+		Author        string               `json:"author"`
+		Contributors  []ContributorRequest `json:"contributors"`
+		ISBN13        string               `json:"isbn_13"`
+		ISBN10        string               `json:"isbn_10"`
+		ExternalID    string               `json:"external_id"`
+		Description   string               `json:"description"`
+		PublishedDate string               `json:"published_date"`
+		Category      string               `json:"category"`
+		SubjectIDs    []string             `json:"subject_ids"`
+		Tags          []string             `json:"tags"`
+		Dewey         string               `json:"dewey"`
+		LCC           string               `json:"lcc"`
 	}
 
 	req := new(UpdateBookRequest)
@@ -71,7 +331,7 @@ func (h *BookHandler) UpdateBook(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
 	resp, err := h.grpcClient.UpdateBook(ctx, &pb.UpdateBookRequest{
@@ -79,27 +339,44 @@ func (h *BookHandler) UpdateBook(c echo.Context) error {
 			Id:            c.Param("id"),
 			Title:         req.Title,
 			Author:        req.Author,
+			Contributors:  contributorsToProto(req.Contributors),
+			Isbn_13:       req.ISBN13,
+			Isbn_10:       req.ISBN10,
+			ExternalId:    req.ExternalID,
+			Description:   req.Description,
 			PublishedDate: req.PublishedDate,
-			Status:        req.Status,
+			Category:      req.Category,
+			SubjectIds:    req.SubjectIDs,
+			Tags:          req.Tags,
+			Dewey:         req.Dewey,
+			Lcc:           req.LCC,
 		},
 	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return errorResponse(c, err)
 	}
 
 	return c.JSON(http.StatusOK, resp.Book)
 }
 
 func (h *BookHandler) DeleteBook(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
 	resp, err := h.grpcClient.DeleteBook(ctx, &pb.DeleteBookRequest{
 		Id: c.Param("id"),
 	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return errorResponse(c, err)
 	}
 
 	return c.JSON(http.StatusOK, map[string]string{"id": resp.Id})
 }
+
+func contributorsToProto(contributors []ContributorRequest) []*pb.Contributor {
+	resp := make([]*pb.Contributor, 0, len(contributors))
+	for _, c := range contributors {
+		resp = append(resp, &pb.Contributor{AuthorId: c.AuthorID, Role: c.Role})
+	}
+	return resp
+}
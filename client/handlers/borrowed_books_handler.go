@@ -1,9 +1,8 @@
 package handlers
 
 import (
-	"context"
 	"net/http"
-	"time"
+	"strconv"
 
 	pb "gc-buku/proto"
 
@@ -18,22 +17,29 @@ func NewBorrowedBooksHandler(client pb.BookServiceClient) *BorrowedBooksHandler
 	return &BorrowedBooksHandler{grpcClient: client}
 }
 
+// BorrowBook lends a copy of the book in the path, or the copy whose barcode
+// is given in the body, e.g. when it is scanned at the desk.
 func (h *BorrowedBooksHandler) BorrowBook(c echo.Context) error {
-	userID := c.Get("user_id").(string)
-	bookID := c.Param("book_id")
+	type BorrowBookRequest struct {
+		BookID  string `param:"book_id" json:"book_id"`
+		Barcode string `json:"barcode"`
+	}
+	req := new(BorrowBookRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
 	resp, err := h.grpcClient.BorrowBook(ctx, &pb.BorrowBookRequest{
 		BorrowedBook: &pb.BorrowedBook{
-			BookId:       bookID,
-			UserId:       userID,
-			BorrowedDate: time.Now().Format(time.RFC3339),
+			BookId: req.BookID,
 		},
+		Barcode: req.Barcode,
 	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return errorResponse(c, err)
 	}
 
 	return c.JSON(http.StatusOK, resp.BorrowedBook)
@@ -42,7 +48,7 @@ func (h *BorrowedBooksHandler) BorrowBook(c echo.Context) error {
 func (h *BorrowedBooksHandler) ReturnBook(c echo.Context) error {
 	borrowID := c.Param("id")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
 	resp, err := h.grpcClient.ReturnBook(ctx, &pb.ReturnBookRequest{
@@ -54,3 +60,68 @@ func (h *BorrowedBooksHandler) ReturnBook(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, resp.BorrowedBook)
 }
+
+func (h *BorrowedBooksHandler) RenewLoan(c echo.Context) error {
+	borrowID := c.Param("id")
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.RenewLoan(ctx, &pb.RenewLoanRequest{
+		Id: borrowID,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, resp.BorrowedBook)
+}
+
+// MyLoans lists the books the caller currently has out.
+func (h *BorrowedBooksHandler) MyLoans(c echo.Context) error {
+	userID, _ := c.Get("user_id").(string)
+	return h.listLoans(c, userID, "open")
+}
+
+// MyHistory lists the caller's returned loans.
+func (h *BorrowedBooksHandler) MyHistory(c echo.Context) error {
+	userID, _ := c.Get("user_id").(string)
+	return h.listLoans(c, userID, "returned")
+}
+
+// UserLoans lists a user's loans, filtered by the status query parameter.
+func (h *BorrowedBooksHandler) UserLoans(c echo.Context) error {
+	return h.listLoans(c, c.Param("id"), c.QueryParam("status"))
+}
+
+func (h *BorrowedBooksHandler) listLoans(c echo.Context, userID, status string) error {
+	req := &pb.ListLoansRequest{
+		UserId:         userID,
+		BookId:         c.QueryParam("book_id"),
+		Status:         status,
+		BorrowedAfter:  c.QueryParam("borrowed_after"),
+		BorrowedBefore: c.QueryParam("borrowed_before"),
+		PageToken:      c.QueryParam("page_token"),
+	}
+
+	if v := c.QueryParam("page_size"); v != "" {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid page_size"})
+		}
+		req.PageSize = int32(pageSize)
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListLoans(ctx, req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"loans":           resp.Loans,
+		"next_page_token": resp.NextPageToken,
+	})
+}
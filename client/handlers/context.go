@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcContext returns the context for a gRPC call made on behalf of c,
+// forwarding the caller's Authorization header and IP address as metadata.
+func grpcContext(c echo.Context) (context.Context, context.CancelFunc) {
+	return grpcContextWithTimeout(c, 5*time.Second)
+}
+
+// grpcContextWithTimeout is grpcContext for calls that take longer, such as
+// imports.
+func grpcContextWithTimeout(c echo.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", c.RealIP())
+	if auth := c.Request().Header.Get("Authorization"); auth != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+	}
+	return ctx, cancel
+}
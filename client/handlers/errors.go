@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// httpStatus maps gRPC status codes to the HTTP status reported to clients.
+var httpStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.FailedPrecondition: http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+}
+
+// errorResponse writes a gRPC error as JSON with the matching HTTP status,
+// including any field violations.
+func errorResponse(c echo.Context, err error) error {
+	st := status.Convert(err)
+	code, ok := httpStatus[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+
+	body := map[string]interface{}{"error": st.Message()}
+	if fields := fieldErrors(err); len(fields) > 0 {
+		body["fields"] = fields
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			body["reason"] = info.Reason
+			if len(info.Metadata) > 0 {
+				body["details"] = info.Metadata
+			}
+		}
+	}
+	return c.JSON(code, body)
+}
+
+// fieldError is a validation failure of a single request field.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors returns the field violations the server attached to err.
+func fieldErrors(err error) []fieldError {
+	var fields []fieldError
+	for _, detail := range status.Convert(err).Details() {
+		badRequest, ok := detail.(*errdetails.BadRequest)
+		if !ok {
+			continue
+		}
+		for _, violation := range badRequest.FieldViolations {
+			fields = append(fields, fieldError{
+				Field:   violation.Field,
+				Message: violation.Description,
+			})
+		}
+	}
+	return fields
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+
+	pb "gc-buku/proto"
+
+	"github.com/labstack/echo/v4"
+)
+
+type FinesHandler struct {
+	grpcClient pb.BookServiceClient
+}
+
+func NewFinesHandler(client pb.BookServiceClient) *FinesHandler {
+	return &FinesHandler{grpcClient: client}
+}
+
+func (h *FinesHandler) ListFines(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListFines(ctx, &pb.ListFinesRequest{
+		UserId: c.Param("id"),
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"entries": resp.Entries,
+		"balance": resp.Balance,
+	})
+}
+
+func (h *FinesHandler) PayFine(c echo.Context) error {
+	type PayFineRequest struct {
+		Amount int64  `json:"amount"`
+		Note   string `json:"note"`
+	}
+	req := new(PayFineRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.PayFine(ctx, &pb.PayFineRequest{
+		UserId: c.Param("id"),
+		Amount: req.Amount,
+		Note:   req.Note,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"entry":   resp.Entry,
+		"balance": resp.Balance,
+	})
+}
+
+func (h *FinesHandler) WaiveFine(c echo.Context) error {
+	type WaiveFineRequest struct {
+		Amount int64  `json:"amount"`
+		Note   string `json:"note"`
+	}
+	req := new(WaiveFineRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.WaiveFine(ctx, &pb.WaiveFineRequest{
+		UserId: c.Param("id"),
+		Amount: req.Amount,
+		Note:   req.Note,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"entry":   resp.Entry,
+		"balance": resp.Balance,
+	})
+}
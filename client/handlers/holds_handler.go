@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+
+	pb "gc-buku/proto"
+
+	"github.com/labstack/echo/v4"
+)
+
+type HoldsHandler struct {
+	grpcClient pb.BookServiceClient
+}
+
+func NewHoldsHandler(client pb.BookServiceClient) *HoldsHandler {
+	return &HoldsHandler{grpcClient: client}
+}
+
+func (h *HoldsHandler) PlaceHold(c echo.Context) error {
+	bookID := c.Param("book_id")
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.PlaceHold(ctx, &pb.PlaceHoldRequest{
+		BookId: bookID,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusCreated, resp.Hold)
+}
+
+func (h *HoldsHandler) CancelHold(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.CancelHold(ctx, &pb.CancelHoldRequest{
+		Id: c.Param("id"),
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, resp.Hold)
+}
+
+func (h *HoldsHandler) ListHolds(c echo.Context) error {
+	req := &pb.ListHoldsRequest{
+		BookId: c.QueryParam("book_id"),
+		UserId: c.QueryParam("user_id"),
+		Status: c.QueryParam("status"),
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListHolds(ctx, req)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"holds": resp.Holds})
+}
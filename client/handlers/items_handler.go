@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+
+	pb "gc-buku/proto"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ItemsHandler struct {
+	grpcClient pb.BookServiceClient
+}
+
+func NewItemsHandler(client pb.BookServiceClient) *ItemsHandler {
+	return &ItemsHandler{grpcClient: client}
+}
+
+func (h *ItemsHandler) ListItems(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListItems(ctx, &pb.ListItemsRequest{
+		BookId: c.Param("id"),
+		Status: c.QueryParam("status"),
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"items": resp.Items})
+}
+
+func (h *ItemsHandler) CreateItem(c echo.Context) error {
+	type CreateItemRequest struct {
+		Barcode   string `json:"barcode"`
+		Location  string `json:"location"`
+		Condition string `json:"condition"`
+	}
+	req := new(CreateItemRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.CreateItem(ctx, &pb.CreateItemRequest{
+		BookId: c.Param("id"),
+		Item: &pb.Item{
+			Barcode:   req.Barcode,
+			Location:  req.Location,
+			Condition: req.Condition,
+		},
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, resp.Item)
+}
+
+func (h *ItemsHandler) UpdateItem(c echo.Context) error {
+	type UpdateItemRequest struct {
+		Location  *string `json:"location"`
+		Condition *string `json:"condition"`
+		Status    *string `json:"status"`
+	}
+	req := new(UpdateItemRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.UpdateItem(ctx, &pb.UpdateItemRequest{
+		Id:        c.Param("id"),
+		Location:  req.Location,
+		Condition: req.Condition,
+		Status:    req.Status,
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp.Item)
+}
+
+func (h *ItemsHandler) DeleteItem(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.DeleteItem(ctx, &pb.DeleteItemRequest{Id: c.Param("id")})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"id": resp.Id})
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	pb "gc-buku/proto"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SubjectsHandler struct {
+	grpcClient pb.BookServiceClient
+}
+
+func NewSubjectsHandler(client pb.BookServiceClient) *SubjectsHandler {
+	return &SubjectsHandler{grpcClient: client}
+}
+
+func (h *SubjectsHandler) CreateSubject(c echo.Context) error {
+	type CreateSubjectRequest struct {
+		Name     string `json:"name"`
+		ParentID string `json:"parent_id"`
+	}
+	req := new(CreateSubjectRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.CreateSubject(ctx, &pb.CreateSubjectRequest{
+		Subject: &pb.Subject{
+			Name:     req.Name,
+			ParentId: req.ParentID,
+		},
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, resp.Subject)
+}
+
+// ListSubjects lists the subjects directly below parent_id, or the top-level
+// subjects without it. With recursive=true it lists the whole subtree.
+func (h *SubjectsHandler) ListSubjects(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListSubjects(ctx, &pb.ListSubjectsRequest{
+		ParentId:  c.QueryParam("parent_id"),
+		Recursive: c.QueryParam("recursive") == "true",
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"subjects": resp.Subjects})
+}
+
+// UpdateSubject renames or moves a subject. A parent_id of "" moves it to the
+// top level.
+func (h *SubjectsHandler) UpdateSubject(c echo.Context) error {
+	type UpdateSubjectRequest struct {
+		Name     *string `json:"name"`
+		ParentID *string `json:"parent_id"`
+	}
+	req := new(UpdateSubjectRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.UpdateSubject(ctx, &pb.UpdateSubjectRequest{
+		Id:       c.Param("id"),
+		Name:     req.Name,
+		ParentId: req.ParentID,
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp.Subject)
+}
+
+func (h *SubjectsHandler) DeleteSubject(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.DeleteSubject(ctx, &pb.DeleteSubjectRequest{Id: c.Param("id")})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"id": resp.Id})
+}
+
+// SubjectBooks lists the books filed under a subject or any subject below it.
+func (h *SubjectsHandler) SubjectBooks(c echo.Context) error {
+	req := &pb.ListBooksRequest{
+		SubjectId:     c.Param("id"),
+		PageToken:     c.QueryParam("page_token"),
+		SortBy:        c.QueryParam("sort_by"),
+		Descending:    c.QueryParam("order") == "desc",
+		IncludeFacets: c.QueryParam("facets") == "true",
+	}
+	if v := c.QueryParam("page_size"); v != "" {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid page_size"})
+		}
+		req.PageSize = int32(pageSize)
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListBooks(ctx, req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	body := map[string]interface{}{
+		"books":           resp.Books,
+		"next_page_token": resp.NextPageToken,
+	}
+	if req.IncludeFacets {
+		body["facets"] = resp.Facets
+	}
+	return c.JSON(http.StatusOK, body)
+}
@@ -1,13 +1,14 @@
 package handlers
 
 import (
-	"context"
 	"net/http"
-	"time"
+	"strconv"
 
 	pb "gc-buku/proto"
 
 	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type UserHandler struct {
@@ -20,25 +21,31 @@ func NewUserHandler(client pb.BookServiceClient) *UserHandler {
 
 func (h *UserHandler) CreateUser(c echo.Context) error {
 	type CreateUserRequest struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		Email       string `json:"email"`
+		DisplayName string `json:"display_name"`
+		Phone       string `json:"phone"`
 	}
 	req := new(CreateUserRequest)
 	if err := c.Bind(req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
 	resp, err := h.grpcClient.CreateUser(ctx, &pb.CreateUserRequest{
 		User: &pb.User{
-			Username: req.Username,
-			Password: req.Password,
+			Username:    req.Username,
+			Email:       req.Email,
+			DisplayName: req.DisplayName,
+			Phone:       req.Phone,
 		},
+		Password: req.Password,
 	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return errorResponse(c, err)
 	}
 
 	return c.JSON(http.StatusOK, resp.User)
@@ -54,30 +61,311 @@ func (h *UserHandler) Login(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
 	resp, err := h.grpcClient.Login(ctx, &pb.LoginRequest{
 		Username: req.Username,
 		Password: req.Password,
 	})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.ResourceExhausted:
+			return c.JSON(http.StatusTooManyRequests, map[string]string{"error": status.Convert(err).Message()})
+		case codes.PermissionDenied:
+			return c.JSON(http.StatusForbidden, map[string]string{"error": status.Convert(err).Message()})
+		}
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"token":         resp.Token,
+		"refresh_token": resp.RefreshToken,
+		"expires_at":    resp.ExpiresAt,
+		"user":          resp.User,
+	})
+}
+
+func (h *UserHandler) RefreshToken(c echo.Context) error {
+	type RefreshTokenRequest struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	req := new(RefreshTokenRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.RefreshToken(ctx, &pb.RefreshTokenRequest{
+		RefreshToken: req.RefreshToken,
+	})
 	if err != nil {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
 	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"token": resp.Token,
-		"user":  resp.User,
+		"token":         resp.Token,
+		"refresh_token": resp.RefreshToken,
+		"expires_at":    resp.ExpiresAt,
 	})
 }
 
+func (h *UserHandler) RequestPasswordReset(c echo.Context) error {
+	type RequestPasswordResetRequest struct {
+		Email string `json:"email"`
+	}
+	req := new(RequestPasswordResetRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	_, err := h.grpcClient.RequestPasswordReset(ctx, &pb.RequestPasswordResetRequest{
+		Email: req.Email,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message": "if the address belongs to a verified account, a reset token has been sent to it",
+	})
+}
+
+func (h *UserHandler) ResetPassword(c echo.Context) error {
+	type ResetPasswordRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	req := new(ResetPasswordRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	_, err := h.grpcClient.ResetPassword(ctx, &pb.ResetPasswordRequest{
+		Token:       req.Token,
+		NewPassword: req.Password,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  status.Convert(err).Message(),
+			"fields": fieldErrors(err),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "password has been reset"})
+}
+
+// VerifyEmail is the target of the link in verification emails.
+func (h *UserHandler) VerifyEmail(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.VerifyEmail(ctx, &pb.VerifyEmailRequest{
+		Token: c.QueryParam("token"),
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, resp.User)
+}
+
+// Logout ends the current session, or every session of the user when
+// all_devices is true.
+func (h *UserHandler) Logout(c echo.Context) error {
+	type LogoutRequest struct {
+		AllDevices bool `json:"all_devices"`
+	}
+	req := new(LogoutRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.Logout(ctx, &pb.LogoutRequest{
+		AllDevices: req.AllDevices,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
 func (h *UserHandler) GetUser(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := grpcContext(c)
 	defer cancel()
 
 	resp, err := h.grpcClient.GetUser(ctx, &pb.GetUserRequest{
 		Id: c.Param("id"),
 	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp.User)
+}
+
+func (h *UserHandler) ListUsers(c echo.Context) error {
+	req := &pb.ListUsersRequest{
+		PageToken:      c.QueryParam("page_token"),
+		Query:          c.QueryParam("q"),
+		Role:           c.QueryParam("role"),
+		MembershipType: c.QueryParam("membership_type"),
+	}
+
+	if v := c.QueryParam("page_size"); v != "" {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid page_size"})
+		}
+		req.PageSize = int32(pageSize)
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.ListUsers(ctx, req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"users":           resp.Users,
+		"next_page_token": resp.NextPageToken,
+	})
+}
+
+// UpdateUser changes only the fields present in the body.
+func (h *UserHandler) UpdateUser(c echo.Context) error {
+	type UpdateUserRequest struct {
+		DisplayName         *string `json:"display_name"`
+		Email               *string `json:"email"`
+		Phone               *string `json:"phone"`
+		MembershipType      *string `json:"membership_type"`
+		MembershipExpiresAt *string `json:"membership_expires_at"`
+	}
+	req := new(UpdateUserRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.UpdateUser(ctx, &pb.UpdateUserRequest{
+		Id:                  c.Param("id"),
+		DisplayName:         req.DisplayName,
+		Email:               req.Email,
+		Phone:               req.Phone,
+		MembershipType:      req.MembershipType,
+		MembershipExpiresAt: req.MembershipExpiresAt,
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp.User)
+}
+
+func (h *UserHandler) ChangePassword(c echo.Context) error {
+	type ChangePasswordRequest struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	req := new(ChangePasswordRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	// Passwords can only be changed by their owner.
+	if c.Param("id") != c.Get("user_id") {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "cannot change another user's password"})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	_, err := h.grpcClient.ChangePassword(ctx, &pb.ChangePasswordRequest{
+		CurrentPassword: req.CurrentPassword,
+		NewPassword:     req.NewPassword,
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "password changed"})
+}
+
+func (h *UserHandler) DeleteUser(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.DeleteUser(ctx, &pb.DeleteUserRequest{
+		Id: c.Param("id"),
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"id": resp.Id})
+}
+
+func (h *UserHandler) UnlockUser(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.UnlockUser(ctx, &pb.UnlockUserRequest{
+		UserId: c.Param("id"),
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, resp.User)
+}
+
+func (h *UserHandler) GrantRole(c echo.Context) error {
+	type GrantRoleRequest struct {
+		Role string `json:"role"`
+	}
+	req := new(GrantRoleRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.GrantRole(ctx, &pb.GrantRoleRequest{
+		UserId: c.Param("id"),
+		Role:   req.Role,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, resp.User)
+}
+
+func (h *UserHandler) RevokeRole(c echo.Context) error {
+	ctx, cancel := grpcContext(c)
+	defer cancel()
+
+	resp, err := h.grpcClient.RevokeRole(ctx, &pb.RevokeRoleRequest{
+		UserId: c.Param("id"),
+		Role:   c.Param("role"),
+	})
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
 	"gc-buku/client/routes"
 
 	pb "gc-buku/proto"
+	"gc-buku/utils"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -15,7 +17,14 @@ import (
 )
 
 func main() {
+	if err := utils.ConfigureJWTFromEnv(); err != nil {
+		log.Fatalf("Failed to configure JWT: %v", err)
+	}
+
 	e := echo.New()
+	// Clients connect directly; X-Forwarded-For is theirs to set and cannot
+	// be trusted.
+	e.IPExtractor = echo.ExtractIPDirect()
 
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
@@ -27,7 +36,13 @@ func main() {
 	}
 
 	// Setup gRPC connection
-	conn, err := grpc.Dial(grpcServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if secret := os.Getenv("GATEWAY_SECRET"); secret != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(gatewayCredentials(secret)))
+	} else {
+		log.Printf("WARNING: GATEWAY_SECRET is not set, the server cannot throttle failed logins per client IP")
+	}
+	conn, err := grpc.Dial(grpcServer, opts...)
 	if err != nil {
 		log.Fatalf("Failed to connect to gRPC server: %v", err)
 	}
@@ -44,3 +59,16 @@ func main() {
 	}
 	e.Logger.Fatal(e.Start(":" + port))
 }
+
+// gatewayCredentials sends the secret shared with the gRPC server on every
+// call, so that the server trusts the client addresses this gateway
+// forwards.
+type gatewayCredentials string
+
+func (c gatewayCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{utils.GatewaySecretMetadata: string(c)}, nil
+}
+
+func (c gatewayCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -1,32 +1,74 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"strings"
+	"time"
 
+	pb "gc-buku/proto"
 	"gc-buku/utils"
 
 	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
-func Auth(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		auth := c.Request().Header.Get("Authorization")
-		if auth == "" {
-			return c.JSON(http.StatusUnauthorized, map[string]string{
-				"error": "missing authorization header",
-			})
-		}
+// Auth validates the bearer token and asks the server whether its session is
+// still active, so tokens of logged out or revoked sessions are refused.
+func Auth(client pb.BookServiceClient) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get("Authorization")
+			if auth == "" {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": "missing authorization header",
+				})
+			}
+
+			token := strings.Replace(auth, "Bearer ", "", 1)
+			claims, err := utils.ValidateToken(token)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": "invalid token",
+				})
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+			if _, err := client.ValidateSession(ctx, &pb.ValidateSessionRequest{}); err != nil {
+				if status.Code(err) == codes.Unauthenticated {
+					return c.JSON(http.StatusUnauthorized, map[string]string{
+						"error": "session revoked or expired",
+					})
+				}
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"error": "failed to validate session",
+				})
+			}
 
-		token := strings.Replace(auth, "Bearer ", "", 1)
-		claims, err := utils.ValidateToken(token)
-		if err != nil {
-			return c.JSON(http.StatusUnauthorized, map[string]string{
-				"error": "invalid token",
-			})
+			c.Set("user_id", claims.UserID)
+			c.Set("role", claims.Role)
+			c.Set("session_id", claims.SessionID)
+			return next(c)
 		}
+	}
+}
 
-		c.Set("user_id", claims.UserID)
-		return next(c)
+// RequirePermission rejects requests whose role does not grant perm. It must
+// run after Auth.
+func RequirePermission(perm string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			role, _ := c.Get("role").(string)
+			if !utils.HasPermission(role, perm) {
+				return c.JSON(http.StatusForbidden, map[string]string{
+					"error": "insufficient permissions",
+				})
+			}
+			return next(c)
+		}
 	}
 }
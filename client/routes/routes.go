@@ -3,6 +3,7 @@ package routes
 import (
 	"gc-buku/client/handlers"
 	"gc-buku/client/middleware"
+	"gc-buku/utils"
 
 	pb "gc-buku/proto"
 
@@ -10,28 +11,111 @@ import (
 )
 
 func RegisterRoutes(e *echo.Echo, client pb.BookServiceClient) {
+	auth := middleware.Auth(client)
+	can := middleware.RequirePermission
+
 	// Handlers
 	userHandler := handlers.NewUserHandler(client)
 	bookHandler := handlers.NewBookHandler(client)
+	itemsHandler := handlers.NewItemsHandler(client)
+	authorsHandler := handlers.NewAuthorsHandler(client)
+	subjectsHandler := handlers.NewSubjectsHandler(client)
 	borrowedBooksHandler := handlers.NewBorrowedBooksHandler(client)
+	holdsHandler := handlers.NewHoldsHandler(client)
+	finesHandler := handlers.NewFinesHandler(client)
 
 	// Public routes
 	e.POST("/register", userHandler.CreateUser)
 	e.POST("/login", userHandler.Login)
+	e.POST("/token/refresh", userHandler.RefreshToken)
+	e.POST("/password/forgot", userHandler.RequestPasswordReset)
+	e.POST("/password/reset", userHandler.ResetPassword)
+	e.GET("/email/verify", userHandler.VerifyEmail)
+
+	// Session routes
+	e.POST("/logout", userHandler.Logout, auth)
 
 	// Protected book routes
-	books := e.Group("/books", middleware.Auth)
+	books := e.Group("/books", auth)
+	{
+		books.POST("", bookHandler.CreateBook, can(utils.PermBooksWrite))
+		books.GET("", bookHandler.ListBooks, can(utils.PermBooksRead))
+		books.GET("/search", bookHandler.SearchBooks, can(utils.PermBooksRead))
+		books.POST("/import", bookHandler.ImportBooks, can(utils.PermBooksWrite))
+		books.GET("/export", bookHandler.ExportBooks, can(utils.PermBooksRead))
+		books.GET("/isbn/:isbn", bookHandler.GetBookByISBN, can(utils.PermBooksRead))
+		books.GET("/:id", bookHandler.GetBook, can(utils.PermBooksRead))
+		books.PUT("/:id", bookHandler.UpdateBook, can(utils.PermBooksWrite))
+		books.DELETE("/:id", bookHandler.DeleteBook, can(utils.PermBooksWrite))
+		books.GET("/:id/items", itemsHandler.ListItems, can(utils.PermBooksRead))
+		books.POST("/:id/items", itemsHandler.CreateItem, can(utils.PermBooksWrite))
+	}
+
+	// Protected author routes
+	authors := e.Group("/authors", auth)
+	{
+		authors.POST("", authorsHandler.CreateAuthor, can(utils.PermBooksWrite))
+		authors.GET("", authorsHandler.ListAuthors, can(utils.PermBooksRead))
+		authors.GET("/:id", authorsHandler.GetAuthor, can(utils.PermBooksRead))
+		authors.GET("/:id/books", authorsHandler.AuthorBooks, can(utils.PermBooksRead))
+		authors.POST("/:id/merge", authorsHandler.MergeAuthors, can(utils.PermBooksWrite))
+	}
+
+	// Protected subject routes
+	subjects := e.Group("/subjects", auth)
+	{
+		subjects.POST("", subjectsHandler.CreateSubject, can(utils.PermBooksWrite))
+		subjects.GET("", subjectsHandler.ListSubjects, can(utils.PermBooksRead))
+		subjects.PATCH("/:id", subjectsHandler.UpdateSubject, can(utils.PermBooksWrite))
+		subjects.DELETE("/:id", subjectsHandler.DeleteSubject, can(utils.PermBooksWrite))
+		subjects.GET("/:id/books", subjectsHandler.SubjectBooks, can(utils.PermBooksRead))
+	}
+
+	// Protected item (copy) routes
+	items := e.Group("/items", auth, can(utils.PermBooksWrite))
 	{
-		books.POST("", bookHandler.CreateBook)
-		books.GET("/:id", bookHandler.GetBook)
-		books.PUT("/:id", bookHandler.UpdateBook)
-		books.DELETE("/:id", bookHandler.DeleteBook)
+		items.PATCH("/:id", itemsHandler.UpdateItem)
+		items.DELETE("/:id", itemsHandler.DeleteItem)
 	}
 
 	// Protected borrowed books routes
-	borrowedBooks := e.Group("/borrowed-books", middleware.Auth)
+	borrowedBooks := e.Group("/borrowed-books", auth, can(utils.PermCirculation))
 	{
+		borrowedBooks.POST("/borrow", borrowedBooksHandler.BorrowBook)
 		borrowedBooks.POST("/borrow/:book_id", borrowedBooksHandler.BorrowBook)
 		borrowedBooks.POST("/return/:id", borrowedBooksHandler.ReturnBook)
+		borrowedBooks.POST("/renew/:id", borrowedBooksHandler.RenewLoan)
+	}
+
+	// The caller's own loans
+	me := e.Group("/me", auth, can(utils.PermCirculation))
+	{
+		me.GET("/loans", borrowedBooksHandler.MyLoans)
+		me.GET("/history", borrowedBooksHandler.MyHistory)
+	}
+
+	// Protected hold routes
+	holds := e.Group("/holds", auth, can(utils.PermCirculation))
+	{
+		holds.GET("", holdsHandler.ListHolds)
+		holds.POST("/:book_id", holdsHandler.PlaceHold)
+		holds.DELETE("/:id", holdsHandler.CancelHold)
+	}
+
+	// Protected user routes
+	users := e.Group("/users", auth)
+	{
+		users.GET("", userHandler.ListUsers, can(utils.PermUsersManage))
+		users.GET("/:id", userHandler.GetUser, can(utils.PermUsersRead))
+		users.PATCH("/:id", userHandler.UpdateUser)
+		users.DELETE("/:id", userHandler.DeleteUser)
+		users.PUT("/:id/password", userHandler.ChangePassword)
+		users.GET("/:id/loans", borrowedBooksHandler.UserLoans, can(utils.PermLoansManage))
+		users.GET("/:id/fines", finesHandler.ListFines, can(utils.PermCirculation))
+		users.POST("/:id/fines/pay", finesHandler.PayFine, can(utils.PermFinesManage))
+		users.POST("/:id/fines/waive", finesHandler.WaiveFine, can(utils.PermFinesWaive))
+		users.POST("/:id/unlock", userHandler.UnlockUser, can(utils.PermUsersManage))
+		users.POST("/:id/roles", userHandler.GrantRole, can(utils.PermRolesManage))
+		users.DELETE("/:id/roles/:role", userHandler.RevokeRole, can(utils.PermRolesManage))
 	}
 }
@@ -0,0 +1,202 @@
+package marc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ISO 2709 delimiters.
+const (
+	subfieldDelimiter = 0x1F
+	fieldTerminator   = 0x1E
+	recordTerminator  = 0x1D
+)
+
+const (
+	leaderLength         = 24
+	directoryEntryLength = 12
+	maxRecordLength      = 99999
+	maxFieldLength       = 9999
+)
+
+// defaultLeader describes a Unicode record of a printed monograph. Its
+// lengths are filled in when the record is written.
+const defaultLeader = "00000nam a2200000 i 4500"
+
+var (
+	// ErrInvalidRecord is wrapped by the errors Reader returns for records it
+	// cannot parse. Reading can carry on with the next record.
+	ErrInvalidRecord = errors.New("invalid MARC record")
+	// ErrTooLong is returned by Writer for records over 99999 bytes or with
+	// fields over 9999 bytes, which the format cannot hold.
+	ErrTooLong = errors.New("too long for a MARC record")
+)
+
+// Reader reads records in the ISO 2709 binary format. Records are expected
+// to be in UTF-8; MARC-8 records are read as is, so characters outside ASCII
+// will be wrong.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next record, or io.EOF when there are no more.
+func (r *Reader) Read() (*Record, error) {
+	for {
+		data, err := r.r.ReadBytes(recordTerminator)
+		if err == io.EOF {
+			// Ignore trailing whitespace, often left by editors.
+			if len(bytes.TrimSpace(data)) == 0 {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("%w: missing record terminator", ErrInvalidRecord)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Records are sometimes separated by newlines.
+		data = bytes.TrimLeft(data, "\r\n")
+		if len(data) == 1 {
+			continue
+		}
+		return parseRecord(data)
+	}
+}
+
+func parseRecord(data []byte) (*Record, error) {
+	if len(data) < leaderLength+1 {
+		return nil, fmt.Errorf("%w: shorter than its leader", ErrInvalidRecord)
+	}
+	leader := string(data[:leaderLength])
+	base, ok := digits(leader[12:17])
+	if !ok || base <= leaderLength || base > len(data) {
+		return nil, fmt.Errorf("%w: bad base address %q", ErrInvalidRecord, leader[12:17])
+	}
+
+	directory := data[leaderLength : base-1]
+	if len(directory)%directoryEntryLength != 0 {
+		return nil, fmt.Errorf("%w: bad directory length", ErrInvalidRecord)
+	}
+
+	rec := &Record{Leader: leader}
+	for i := 0; i < len(directory); i += directoryEntryLength {
+		entry := directory[i : i+directoryEntryLength]
+		tag := string(entry[:3])
+		length, ok1 := digits(string(entry[3:7]))
+		start, ok2 := digits(string(entry[7:12]))
+		if !ok1 || !ok2 || length < 1 || base+start+length > len(data) {
+			return nil, fmt.Errorf("%w: bad directory entry for field %s", ErrInvalidRecord, tag)
+		}
+
+		// Drop the field terminator.
+		field := data[base+start : base+start+length-1]
+		if isControlTag(tag) {
+			rec.AddControlField(tag, string(field))
+			continue
+		}
+		if len(field) < 2 {
+			return nil, fmt.Errorf("%w: field %s has no indicators", ErrInvalidRecord, tag)
+		}
+
+		f := DataField{Tag: tag, Ind1: field[0], Ind2: field[1]}
+		for _, sub := range bytes.Split(field[2:], []byte{subfieldDelimiter}) {
+			if len(sub) == 0 {
+				continue
+			}
+			f.Subfields = append(f.Subfields, Subfield{Code: sub[0], Value: string(sub[1:])})
+		}
+		rec.DataFields = append(rec.DataFields, f)
+	}
+	return rec, nil
+}
+
+// digits parses a number field of the leader or directory, which must be
+// all ASCII digits: no sign or spaces.
+func digits(s string) (int, bool) {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+		n = n*10 + int(s[i]-'0')
+	}
+	return n, len(s) > 0
+}
+
+// Writer writes records in the ISO 2709 binary format, encoded in UTF-8.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Write(rec *Record) error {
+	var directory, fields bytes.Buffer
+	addField := func(tag string, data []byte) error {
+		if len(data)+1 > maxFieldLength {
+			return fmt.Errorf("%w: field %s is longer than %d bytes", ErrTooLong, tag, maxFieldLength)
+		}
+		fmt.Fprintf(&directory, "%3.3s%04d%05d", tag, len(data)+1, fields.Len())
+		fields.Write(data)
+		fields.WriteByte(fieldTerminator)
+		return nil
+	}
+
+	for _, f := range rec.ControlFields {
+		if err := addField(f.Tag, []byte(f.Value)); err != nil {
+			return err
+		}
+	}
+	for _, f := range rec.DataFields {
+		data := []byte{indicator(f.Ind1), indicator(f.Ind2)}
+		for _, s := range f.Subfields {
+			data = append(data, subfieldDelimiter, s.Code)
+			data = append(data, s.Value...)
+		}
+		if err := addField(f.Tag, data); err != nil {
+			return err
+		}
+	}
+	directory.WriteByte(fieldTerminator)
+
+	base := leaderLength + directory.Len()
+	length := base + fields.Len() + 1
+	if length > maxRecordLength {
+		return fmt.Errorf("%w: record is longer than %d bytes", ErrTooLong, maxRecordLength)
+	}
+
+	leader := []byte(defaultLeader)
+	if len(rec.Leader) == leaderLength {
+		copy(leader, rec.Leader)
+	}
+	copy(leader[0:5], fmt.Sprintf("%05d", length))
+	leader[9] = 'a'
+	copy(leader[10:12], "22")
+	copy(leader[12:17], fmt.Sprintf("%05d", base))
+	copy(leader[20:24], "4500")
+
+	out := make([]byte, 0, length)
+	out = append(out, leader...)
+	out = append(out, directory.Bytes()...)
+	out = append(out, fields.Bytes()...)
+	out = append(out, recordTerminator)
+	_, err := w.w.Write(out)
+	return err
+}
+
+// indicator returns ind, or a blank for an unset indicator.
+func indicator(ind byte) byte {
+	if ind == 0 {
+		return ' '
+	}
+	return ind
+}
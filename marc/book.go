@@ -0,0 +1,253 @@
+package marc
+
+import (
+	"regexp"
+	"strings"
+)
+
+// SubjectSeparator joins the parts of a subject heading: the topical term
+// in 650 $a and its subdivisions in $x, $y and $z.
+const SubjectSeparator = " -- "
+
+// relatorTerms maps relator codes ($4) and abbreviated terms ($e) to terms.
+var relatorTerms = map[string]string{
+	"aut":    "author",
+	"edt":    "editor",
+	"ed":     "editor",
+	"trl":    "translator",
+	"tr":     "translator",
+	"trans":  "translator",
+	"transl": "translator",
+	"ill":    "illustrator",
+	"comp":   "compiler",
+}
+
+var yearPattern = regexp.MustCompile(`[0-9]{4}`)
+
+// Book is the part of a bibliographic record the catalog keeps.
+type Book struct {
+	// ControlNumber is the record's ID in the system that created it (001).
+	ControlNumber string
+	// Title is the title proper and remainder of title (245 $a and $b).
+	Title        string
+	Contributors []Contributor
+	// ISBNs as written in 020 $a, without qualifiers such as "(pbk.)".
+	ISBNs []string
+	// Subjects are topical headings (650), with subdivisions joined by
+	// SubjectSeparator.
+	Subjects []string
+	// Publication statement (264, or 260 in older records).
+	Place     string
+	Publisher string
+	Date      string
+}
+
+// Contributor is a person credited in 100 or 700. Role is the relator term
+// from $e or $4, lowercased and spelled out; "author" when neither is
+// given.
+type Contributor struct {
+	Name string
+	Role string
+}
+
+// Year returns the first four-digit year in the publication date, or "".
+func (b Book) Year() string {
+	return yearPattern.FindString(b.Date)
+}
+
+// BookFromRecord extracts a book from a bibliographic record, dropping ISBD
+// punctuation.
+func BookFromRecord(rec *Record) Book {
+	book := Book{ControlNumber: strings.TrimSpace(rec.ControlField("001"))}
+
+	if fields := rec.Fields("245"); len(fields) > 0 {
+		parts := []string{}
+		for _, v := range []string{fields[0].Subfield('a'), fields[0].Subfield('b')} {
+			if v = trimFullStop(trimPunctuation(v)); v != "" {
+				parts = append(parts, v)
+			}
+		}
+		book.Title = strings.Join(parts, ": ")
+	}
+
+	for _, tag := range []string{"100", "700"} {
+		for _, f := range rec.Fields(tag) {
+			name := trimFullStop(trimPunctuation(f.Subfield('a')))
+			if name == "" {
+				continue
+			}
+			book.Contributors = append(book.Contributors, Contributor{Name: name, Role: relator(f)})
+		}
+	}
+
+	for _, f := range rec.Fields("020") {
+		if isbn := strings.Fields(f.Subfield('a')); len(isbn) > 0 {
+			book.ISBNs = append(book.ISBNs, isbn[0])
+		}
+	}
+
+	for _, f := range rec.Fields("650") {
+		var parts []string
+		for _, s := range f.Subfields {
+			switch s.Code {
+			case 'a', 'x', 'y', 'z':
+				if v := trimFullStop(trimPunctuation(s.Value)); v != "" {
+					parts = append(parts, v)
+				}
+			}
+		}
+		if len(parts) > 0 {
+			book.Subjects = append(book.Subjects, strings.Join(parts, SubjectSeparator))
+		}
+	}
+
+	// 264 with second indicator 1 is the publication statement; older
+	// records use 260.
+	var publication *DataField
+	for _, f := range rec.Fields("264") {
+		if f.Ind2 == '1' {
+			publication = &f
+			break
+		}
+	}
+	if publication == nil {
+		if fields := rec.Fields("260"); len(fields) > 0 {
+			publication = &fields[0]
+		}
+	}
+	if publication != nil {
+		book.Place = trimBrackets(trimPunctuation(publication.Subfield('a')))
+		book.Publisher = trimBrackets(trimPunctuation(publication.Subfield('b')))
+		book.Date = trimBrackets(trimPunctuation(publication.Subfield('c')))
+	}
+
+	return book
+}
+
+// Record returns the book as a bibliographic record, with fields in tag
+// order.
+func (b Book) Record() *Record {
+	rec := &Record{Leader: defaultLeader}
+	if b.ControlNumber != "" {
+		rec.AddControlField("001", b.ControlNumber)
+	}
+
+	for _, isbn := range b.ISBNs {
+		rec.AddDataField("020", ' ', ' ', Subfield{Code: 'a', Value: isbn})
+	}
+
+	// The first author is the main entry; everyone else is an added entry.
+	mainEntry := -1
+	for i, c := range b.Contributors {
+		if c.Role == "" || c.Role == "author" {
+			mainEntry = i
+			break
+		}
+	}
+	if mainEntry >= 0 {
+		rec.DataFields = append(rec.DataFields, contributorField("100", b.Contributors[mainEntry]))
+	}
+
+	titleInd1 := byte('0')
+	if mainEntry >= 0 {
+		titleInd1 = '1'
+	}
+	rec.AddDataField("245", titleInd1, nonfilingCharacters(b.Title), Subfield{Code: 'a', Value: b.Title})
+
+	if b.Place != "" || b.Publisher != "" || b.Date != "" {
+		var subfields []Subfield
+		for _, s := range []Subfield{{'a', b.Place}, {'b', b.Publisher}, {'c', b.Date}} {
+			if s.Value != "" {
+				subfields = append(subfields, s)
+			}
+		}
+		rec.AddDataField("264", ' ', '1', subfields...)
+	}
+
+	for _, subject := range b.Subjects {
+		var subfields []Subfield
+		for i, part := range strings.Split(subject, SubjectSeparator) {
+			code := byte('x')
+			if i == 0 {
+				code = 'a'
+			}
+			subfields = append(subfields, Subfield{Code: code, Value: part})
+		}
+		// Second indicator 4: a heading from a local scheme.
+		rec.AddDataField("650", ' ', '4', subfields...)
+	}
+
+	for i, c := range b.Contributors {
+		if i != mainEntry {
+			rec.DataFields = append(rec.DataFields, contributorField("700", c))
+		}
+	}
+
+	return rec
+}
+
+func contributorField(tag string, c Contributor) DataField {
+	// First indicator 1 marks a name written surname first.
+	ind1 := byte('0')
+	if strings.Contains(c.Name, ",") {
+		ind1 = '1'
+	}
+	role := c.Role
+	if role == "" {
+		role = "author"
+	}
+	return DataField{Tag: tag, Ind1: ind1, Ind2: ' ', Subfields: []Subfield{
+		{Code: 'a', Value: c.Name},
+		{Code: 'e', Value: role},
+	}}
+}
+
+// relator returns the role a name field credits.
+func relator(f DataField) string {
+	for _, term := range []string{f.Subfield('e'), f.Subfield('4')} {
+		term = strings.ToLower(strings.TrimRight(trimPunctuation(term), "."))
+		if spelled, ok := relatorTerms[term]; ok {
+			return spelled
+		}
+		if term != "" {
+			return term
+		}
+	}
+	return "author"
+}
+
+// nonfilingCharacters returns the second indicator of 245: how many leading
+// characters, such as an initial article, are ignored when sorting.
+func nonfilingCharacters(title string) byte {
+	lower := strings.ToLower(title)
+	for _, article := range []string{"the ", "an ", "a "} {
+		if strings.HasPrefix(lower, article) {
+			return byte('0' + len(article))
+		}
+	}
+	return '0'
+}
+
+// trimPunctuation removes the ISBD punctuation that ends subfields, such as
+// the " /" before a statement of responsibility. Full stops are kept, as
+// they may end an initial or abbreviation.
+func trimPunctuation(s string) string {
+	return strings.TrimSpace(strings.TrimRight(strings.TrimSpace(s), " /:;,="))
+}
+
+// trimFullStop removes a full stop ending s, unless it ends an initial.
+func trimFullStop(s string) string {
+	if !strings.HasSuffix(s, ".") {
+		return s
+	}
+	words := strings.Fields(s)
+	last := strings.TrimSuffix(words[len(words)-1], ".")
+	if len(last) <= 1 || strings.Contains(last, ".") {
+		return s
+	}
+	return strings.TrimSuffix(s, ".")
+}
+
+func trimBrackets(s string) string {
+	return strings.TrimSpace(strings.Trim(s, "[]"))
+}
@@ -0,0 +1,155 @@
+package marc
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// Namespace is the MARCXML namespace.
+const Namespace = "http://www.loc.gov/MARC21/slim"
+
+type xmlRecord struct {
+	XMLName       xml.Name          `xml:"record"`
+	Leader        string            `xml:"leader,omitempty"`
+	ControlFields []xmlControlField `xml:"controlfield"`
+	DataFields    []xmlDataField    `xml:"datafield"`
+}
+
+type xmlControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlDataField struct {
+	Tag       string        `xml:"tag,attr"`
+	Ind1      string        `xml:"ind1,attr"`
+	Ind2      string        `xml:"ind2,attr"`
+	Subfields []xmlSubfield `xml:"subfield"`
+}
+
+type xmlSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// XMLReader reads the records of a MARCXML document, whether a collection
+// or a single record.
+type XMLReader struct {
+	d *xml.Decoder
+}
+
+func NewXMLReader(r io.Reader) *XMLReader {
+	return &XMLReader{d: xml.NewDecoder(r)}
+}
+
+// Read returns the next record, or io.EOF when there are no more. Unlike
+// Reader, it cannot carry on after malformed XML.
+func (r *XMLReader) Read() (*Record, error) {
+	for {
+		tok, err := r.d.Token()
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "record" {
+			continue
+		}
+
+		var x xmlRecord
+		if err := r.d.DecodeElement(&x, &start); err != nil {
+			return nil, err
+		}
+		return x.record()
+	}
+}
+
+func (x xmlRecord) record() (*Record, error) {
+	rec := &Record{Leader: x.Leader}
+	for _, f := range x.ControlFields {
+		rec.AddControlField(f.Tag, f.Value)
+	}
+	for _, f := range x.DataFields {
+		field := DataField{Tag: f.Tag, Ind1: xmlIndicator(f.Ind1), Ind2: xmlIndicator(f.Ind2)}
+		for _, s := range f.Subfields {
+			if len(s.Code) != 1 {
+				return nil, fmt.Errorf("%w: field %s has subfield code %q", ErrInvalidRecord, f.Tag, s.Code)
+			}
+			field.Subfields = append(field.Subfields, Subfield{Code: s.Code[0], Value: s.Value})
+		}
+		rec.DataFields = append(rec.DataFields, field)
+	}
+	return rec, nil
+}
+
+func xmlIndicator(ind string) byte {
+	if ind == "" {
+		return ' '
+	}
+	return ind[0]
+}
+
+// XMLWriter writes records as a MARCXML collection. Close must be called to
+// end the document.
+type XMLWriter struct {
+	w       io.Writer
+	e       *xml.Encoder
+	started bool
+	records int
+}
+
+func NewXMLWriter(w io.Writer) *XMLWriter {
+	e := xml.NewEncoder(w)
+	e.Indent("  ", "  ")
+	return &XMLWriter{w: w, e: e}
+}
+
+func (w *XMLWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	_, err := fmt.Fprintf(w.w, "%s<collection xmlns=%q>\n", xml.Header, Namespace)
+	return err
+}
+
+func (w *XMLWriter) Write(rec *Record) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	x := xmlRecord{Leader: rec.Leader}
+	for _, f := range rec.ControlFields {
+		x.ControlFields = append(x.ControlFields, xmlControlField{Tag: f.Tag, Value: f.Value})
+	}
+	for _, f := range rec.DataFields {
+		field := xmlDataField{
+			Tag:  f.Tag,
+			Ind1: string(indicator(f.Ind1)),
+			Ind2: string(indicator(f.Ind2)),
+		}
+		for _, s := range f.Subfields {
+			field.Subfields = append(field.Subfields, xmlSubfield{Code: string(s.Code), Value: s.Value})
+		}
+		x.DataFields = append(x.DataFields, field)
+	}
+
+	if err := w.e.EncodeElement(x, xml.StartElement{Name: xml.Name{Local: "record"}}); err != nil {
+		return err
+	}
+	w.records++
+	return w.e.Flush()
+}
+
+// Close ends the collection. It does not close the underlying writer.
+func (w *XMLWriter) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	end := "</collection>\n"
+	if w.records > 0 {
+		end = "\n" + end
+	}
+	_, err := io.WriteString(w.w, end)
+	return err
+}
@@ -0,0 +1,227 @@
+// Command marcconv converts book records between MARC21, MARCXML and the
+// JSON Lines accepted by the book import, without a running server.
+//
+//	marcconv -from marc21 -to jsonl records.mrc > books.jsonl
+//	marcconv -from jsonl -to marcxml -o books.xml books.jsonl
+//
+// Only the fields the catalog keeps are carried over: control number,
+// title, contributors, ISBNs, subjects and publication.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"gc-buku/marc"
+)
+
+// jsonRow is a book in the JSON Lines format of the book import.
+type jsonRow struct {
+	ExternalID    string            `json:"external_id,omitempty"`
+	Title         string            `json:"title"`
+	Author        string            `json:"author,omitempty"`
+	Contributors  []jsonContributor `json:"contributors,omitempty"`
+	ISBN          string            `json:"isbn,omitempty"`
+	PublishedDate string            `json:"published_date,omitempty"`
+	Subjects      []string          `json:"subjects,omitempty"`
+}
+
+type jsonContributor struct {
+	Name string `json:"name"`
+	Role string `json:"role,omitempty"`
+}
+
+func main() {
+	from := flag.String("from", "marc21", "input format: marc21, marcxml or jsonl")
+	to := flag.String("to", "jsonl", "output format: marc21, marcxml or jsonl")
+	output := flag.String("o", "", "output file (default standard output)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: marcconv [-from format] [-to format] [-o file] [file]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("marcconv: ")
+
+	var in io.Reader = os.Stdin
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	read, err := newReader(*from, in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	bw := bufio.NewWriter(out)
+
+	write, end, err := newWriter(*to, bw)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := convert(read, write); err != nil {
+		log.Fatal(err)
+	}
+	if err := end(); err != nil {
+		log.Fatal(err)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// convert copies every book from read to write. Records that cannot be
+// parsed or written are reported and left out.
+func convert(read func() (marc.Book, error), write func(marc.Book) error) error {
+	for n := 1; ; n++ {
+		book, err := read()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, marc.ErrInvalidRecord) {
+			log.Printf("record %d: %v", n, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+
+		if err := write(book); err != nil {
+			if errors.Is(err, marc.ErrTooLong) {
+				log.Printf("record %d: %v", n, err)
+				continue
+			}
+			return err
+		}
+	}
+}
+
+func newReader(format string, r io.Reader) (func() (marc.Book, error), error) {
+	var read func() (*marc.Record, error)
+	switch format {
+	case "marc21":
+		read = marc.NewReader(r).Read
+	case "marcxml":
+		read = marc.NewXMLReader(r).Read
+	case "jsonl":
+		return jsonlReader(r), nil
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+	return func() (marc.Book, error) {
+		rec, err := read()
+		if err != nil {
+			return marc.Book{}, err
+		}
+		return marc.BookFromRecord(rec), nil
+	}, nil
+}
+
+// newWriter returns a function writing a book and one ending the output.
+func newWriter(format string, w io.Writer) (func(marc.Book) error, func() error, error) {
+	end := func() error { return nil }
+	switch format {
+	case "marc21":
+		mw := marc.NewWriter(w)
+		return func(b marc.Book) error { return mw.Write(b.Record()) }, end, nil
+	case "marcxml":
+		xw := marc.NewXMLWriter(w)
+		return func(b marc.Book) error { return xw.Write(b.Record()) }, xw.Close, nil
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return func(b marc.Book) error { return enc.Encode(bookRow(b)) }, end, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// jsonlReader reads the rows of a JSON Lines file as books, skipping blank
+// lines. A row that is not valid JSON is reported as an invalid record.
+func jsonlReader(r io.Reader) func() (marc.Book, error) {
+	br := bufio.NewReader(r)
+	return func() (marc.Book, error) {
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(strings.TrimSpace(string(line))) == 0 {
+				if err != nil {
+					return marc.Book{}, err
+				}
+				continue
+			}
+			if err != nil && err != io.EOF {
+				return marc.Book{}, err
+			}
+
+			var row jsonRow
+			if err := json.Unmarshal(line, &row); err != nil {
+				return marc.Book{}, fmt.Errorf("%w: %v", marc.ErrInvalidRecord, err)
+			}
+			return rowBook(row), nil
+		}
+	}
+}
+
+func rowBook(row jsonRow) marc.Book {
+	book := marc.Book{
+		ControlNumber: row.ExternalID,
+		Title:         row.Title,
+		Subjects:      row.Subjects,
+		Date:          row.PublishedDate,
+	}
+	// Keep only the year of a full date, as MARC records give it.
+	book.Date = book.Year()
+	for _, c := range row.Contributors {
+		book.Contributors = append(book.Contributors, marc.Contributor{Name: c.Name, Role: c.Role})
+	}
+	if len(book.Contributors) == 0 && row.Author != "" {
+		book.Contributors = []marc.Contributor{{Name: row.Author, Role: "author"}}
+	}
+	if row.ISBN != "" {
+		book.ISBNs = []string{row.ISBN}
+	}
+	return book
+}
+
+func bookRow(book marc.Book) jsonRow {
+	row := jsonRow{
+		ExternalID:    book.ControlNumber,
+		Title:         book.Title,
+		PublishedDate: book.Year(),
+		Subjects:      book.Subjects,
+	}
+	for _, c := range book.Contributors {
+		row.Contributors = append(row.Contributors, jsonContributor{Name: c.Name, Role: c.Role})
+	}
+	if len(book.ISBNs) > 0 {
+		row.ISBN = book.ISBNs[0]
+	}
+	return row
+}
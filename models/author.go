@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ContributorRoleAuthor     = "author"
+	ContributorRoleEditor     = "editor"
+	ContributorRoleTranslator = "translator"
+)
+
+// Author is a person credited on books, however the books spell their name.
+type Author struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty"`
+	Name string             `bson:"name"`
+	// Aliases are other spellings of the name, such as those of duplicates
+	// merged into this author.
+	Aliases   []string  `bson:"aliases,omitempty"`
+	Bio       string    `bson:"bio,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// Contributor credits an author on a book in a role. Name is a copy of the
+// author's name so books can be shown without looking authors up.
+type Contributor struct {
+	AuthorID primitive.ObjectID `bson:"author_id"`
+	Name     string             `bson:"name"`
+	Role     string             `bson:"role"`
+}
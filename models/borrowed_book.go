@@ -6,10 +6,27 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	LoanStatusActive   = "active"
+	LoanStatusOverdue  = "overdue"
+	LoanStatusReturned = "returned"
+)
+
 type BorrowedBook struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty"`
 	BookID       primitive.ObjectID `bson:"book_id"`
+	ItemID       primitive.ObjectID `bson:"item_id,omitempty"`
 	UserID       primitive.ObjectID `bson:"user_id"`
 	BorrowedDate time.Time          `bson:"borrowed_date"`
+	DueDate      time.Time          `bson:"due_date"`
 	ReturnDate   *time.Time         `bson:"return_date,omitempty"`
+	Status       string             `bson:"status,omitempty"`
+	RenewalCount int                `bson:"renewal_count"`
+	Renewals     []LoanRenewal      `bson:"renewals,omitempty"`
+}
+
+type LoanRenewal struct {
+	RenewedAt       time.Time `bson:"renewed_at"`
+	PreviousDueDate time.Time `bson:"previous_due_date"`
+	DueDate         time.Time `bson:"due_date"`
 }
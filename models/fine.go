@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	FineEntryCharge  = "charge"
+	FineEntryPayment = "payment"
+	FineEntryWaiver  = "waiver"
+)
+
+// FineEntry is a single line in a user's fines ledger. Amounts are in the
+// smallest currency unit; a user's balance is their charges minus payments
+// and waivers. Overdue charges are keyed by LoanID and grow while the loan
+// stays open.
+type FineEntry struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID  `bson:"user_id"`
+	LoanID    *primitive.ObjectID `bson:"loan_id,omitempty"`
+	Type      string              `bson:"type"`
+	Amount    int64               `bson:"amount"`
+	Note      string              `bson:"note,omitempty"`
+	CreatedBy *primitive.ObjectID `bson:"created_by,omitempty"`
+	CreatedAt time.Time           `bson:"created_at"`
+	UpdatedAt time.Time           `bson:"updated_at"`
+}
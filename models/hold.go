@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	HoldStatusWaiting   = "waiting"
+	HoldStatusReady     = "ready"
+	HoldStatusFulfilled = "fulfilled"
+	HoldStatusCancelled = "cancelled"
+	HoldStatusExpired   = "expired"
+)
+
+// Hold is a patron's place in the queue for a book. Holds are served in
+// CreatedAt order; the head of the queue becomes ready when a copy is
+// returned, and that copy, ItemID, stays reserved until ExpiresAt.
+type Hold struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	BookID    primitive.ObjectID `bson:"book_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	ItemID    primitive.ObjectID `bson:"item_id,omitempty"`
+	Status    string             `bson:"status"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ReadyAt   *time.Time         `bson:"ready_at,omitempty"`
+	ExpiresAt *time.Time         `bson:"expires_at,omitempty"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ItemStatusAvailable   = "available"
+	ItemStatusBorrowed    = "borrowed"
+	ItemStatusOverdue     = "overdue"
+	ItemStatusOnHoldShelf = "on_hold_shelf"
+	ItemStatusMaintenance = "maintenance"
+	ItemStatusLost        = "lost"
+)
+
+const (
+	ItemConditionNew     = "new"
+	ItemConditionGood    = "good"
+	ItemConditionFair    = "fair"
+	ItemConditionPoor    = "poor"
+	ItemConditionDamaged = "damaged"
+)
+
+// Item is a physical copy of a Title. UserID is the borrower while the copy
+// is on loan, or the patron it is kept for while on the hold shelf.
+type Item struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	TitleID   primitive.ObjectID `bson:"title_id"`
+	Barcode   string             `bson:"barcode"`
+	Location  string             `bson:"location,omitempty"`
+	Condition string             `bson:"condition"`
+	Status    string             `bson:"status"`
+	UserID    primitive.ObjectID `bson:"user_id,omitempty"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
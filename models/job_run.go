@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	JobRunRunning   = "running"
+	JobRunSucceeded = "succeeded"
+	JobRunFailed    = "failed"
+)
+
+// JobRun is one execution of a scheduled job.
+type JobRun struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	Job        string             `bson:"job"`
+	Status     string             `bson:"status"`
+	Message    string             `bson:"message,omitempty"`
+	Error      string             `bson:"error,omitempty"`
+	StartedAt  time.Time          `bson:"started_at"`
+	FinishedAt *time.Time         `bson:"finished_at,omitempty"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Loan policy scopes, from least to most specific.
+const (
+	LoanPolicyScopeDefault    = "default"
+	LoanPolicyScopeCategory   = "category"
+	LoanPolicyScopeMembership = "membership"
+	LoanPolicyScopeRole       = "role"
+)
+
+// LoanPolicy overrides loan terms for its scope. Unset fields are inherited
+// from less specific policies.
+type LoanPolicy struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty"`
+	Scope            string             `bson:"scope"`
+	Key              string             `bson:"key,omitempty"`
+	LoanDays         *int               `bson:"loan_days,omitempty"`
+	MaxRenewals      *int               `bson:"max_renewals,omitempty"`
+	RenewalGraceDays *int               `bson:"renewal_grace_days,omitempty"`
+	FinePerDay       *int64             `bson:"fine_per_day,omitempty"`
+	// MaxLoans is how many books a user may have out at once.
+	MaxLoans *int `bson:"max_loans,omitempty"`
+	// MaxFineBalance is the highest unpaid fine balance a user may have and
+	// still borrow.
+	MaxFineBalance *int64 `bson:"max_fine_balance,omitempty"`
+	// BlockOverdue stops users with overdue loans from borrowing more.
+	BlockOverdue *bool `bson:"block_overdue,omitempty"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// LoginAttempt counts recent failed logins for one username or client IP.
+// The key is "user:<username>" or "ip:<address>".
+type LoginAttempt struct {
+	Key           string     `bson:"_id"`
+	Failures      int        `bson:"failures"`
+	LastFailureAt time.Time  `bson:"last_failure_at"`
+	RetryAfter    *time.Time `bson:"retry_after,omitempty"`
+	LockedUntil   *time.Time `bson:"locked_until,omitempty"`
+	// ExpiresAt is when the record is forgotten, counting from the last
+	// failure or the end of a lockout, whichever is later.
+	ExpiresAt time.Time `bson:"expires_at"`
+}
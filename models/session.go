@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session is a login on one device. Access tokens carry the session ID and
+// stop working once the session is revoked; the refresh token is stored only
+// as a SHA-256 hash.
+type Session struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty"`
+	UserID           primitive.ObjectID `bson:"user_id"`
+	RefreshTokenHash string             `bson:"refresh_token_hash"`
+	CreatedAt        time.Time          `bson:"created_at"`
+	LastUsedAt       time.Time          `bson:"last_used_at"`
+	ExpiresAt        time.Time          `bson:"expires_at"`
+	RevokedAt        *time.Time         `bson:"revoked_at,omitempty"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Subject is a node in the subject taxonomy. Ancestors lists the IDs from the
+// root down to the parent, so a subtree can be found with a single query.
+type Subject struct {
+	ID        primitive.ObjectID   `bson:"_id,omitempty"`
+	Name      string               `bson:"name"`
+	ParentID  primitive.ObjectID   `bson:"parent_id,omitempty"`
+	Ancestors []primitive.ObjectID `bson:"ancestors"`
+	CreatedAt time.Time            `bson:"created_at"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A title's status summarises its copies: available while any copy is on
+// the shelf, otherwise on_hold_shelf or borrowed, and unavailable when no
+// copy circulates.
+const (
+	TitleStatusAvailable   = "available"
+	TitleStatusOnHoldShelf = "on_hold_shelf"
+	TitleStatusBorrowed    = "borrowed"
+	TitleStatusUnavailable = "unavailable"
+)
+
+// Title is a bibliographic record. The physical copies that are lent out are
+// Items. Titles live in the books collection, so book IDs used by loans, holds
+// and the API are title IDs.
+type Title struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	Title string             `bson:"title"`
+	// Author is the contributors as one display string, kept for searching
+	// and for clients that predate contributors.
+	Author       string        `bson:"author"`
+	Contributors []Contributor `bson:"contributors,omitempty"`
+	ISBN         string        `bson:"isbn,omitempty"`
+	// ExternalID is the book's ID in the system it was imported from.
+	ExternalID    string               `bson:"external_id,omitempty"`
+	Description   string               `bson:"description,omitempty"`
+	PublishedDate time.Time            `bson:"published_date"`
+	Category      string               `bson:"category,omitempty"`
+	SubjectIDs    []primitive.ObjectID `bson:"subject_ids,omitempty"`
+	Tags          []string             `bson:"tags,omitempty"`
+	// Call numbers in the Dewey Decimal and Library of Congress schemes.
+	Dewey string `bson:"dewey,omitempty"`
+	LCC   string `bson:"lcc,omitempty"`
+	// Status and the copy counts are derived from the title's items.
+	Status          string `bson:"status"`
+	TotalCopies     int    `bson:"total_copies"`
+	AvailableCopies int    `bson:"available_copies"`
+}
@@ -1,11 +1,37 @@
 package models
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	RolePatron    = "patron"
+	RoleLibrarian = "librarian"
+	RoleAdmin     = "admin"
+)
+
+const (
+	MembershipStandard = "standard"
+	MembershipStudent  = "student"
+	MembershipStaff    = "staff"
+)
+
 type User struct {
 	ID       primitive.ObjectID `bson:"_id,omitempty"`
 	Username string             `bson:"username"`
 	Password string             `bson:"password"`
+	Role     string             `bson:"role,omitempty"`
+	Email    string             `bson:"email,omitempty"`
+	// EmailVerified is set once the user follows the verification link
+	// sent to Email.
+	EmailVerified bool   `bson:"email_verified,omitempty"`
+	DisplayName   string `bson:"display_name,omitempty"`
+	Phone         string `bson:"phone,omitempty"`
+	// MembershipType is empty for users created before memberships existed,
+	// who are treated as standard members.
+	MembershipType      string     `bson:"membership_type,omitempty"`
+	MembershipExpiresAt *time.Time `bson:"membership_expires_at,omitempty"`
+	CreatedAt           time.Time  `bson:"created_at,omitempty"`
 }
@@ -2,50 +2,284 @@ package scheduler
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"sort"
+	"sync"
 	"time"
 
+	"gc-buku/models"
+	pb "gc-buku/proto"
+	"gc-buku/services"
+
+	"github.com/robfig/cron/v3"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Job is a named task run on a cron schedule. Run returns a short summary
+// that is stored in the job's run history.
+type Job struct {
+	Name     string
+	Schedule string
+	Run      func(ctx context.Context) (string, error)
+}
+
 type BookScheduler struct {
-	db *mongo.Database
+	db          *mongo.Database
+	holdService *services.HoldService
+	fineService *services.FineService
+
+	cron    *cron.Cron
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	jobs    map[string]Job
+	entries map[string]cron.EntryID
 }
 
 func NewBookScheduler(db *mongo.Database) *BookScheduler {
-	return &BookScheduler{db: db}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &BookScheduler{
+		db:          db,
+		holdService: services.NewHoldService(db),
+		fineService: services.NewFineService(db),
+		cron: cron.New(cron.WithChain(
+			cron.Recover(cron.DefaultLogger),
+			cron.SkipIfStillRunning(cron.DefaultLogger),
+		)),
+		ctx:     ctx,
+		cancel:  cancel,
+		jobs:    make(map[string]Job),
+		entries: make(map[string]cron.EntryID),
+	}
+
+	for _, job := range []Job{
+		{Name: "mark-overdue-loans", Schedule: "0 * * * *", Run: s.checkOverdueBooks},
+		{Name: "accrue-fines", Schedule: "5 * * * *", Run: s.accrueFines},
+		{Name: "expire-holds", Schedule: "*/15 * * * *", Run: s.expireHolds},
+	} {
+		if err := s.Register(job); err != nil {
+			log.Fatalf("Failed to register job %s: %v", job.Name, err)
+		}
+	}
+
+	return s
+}
+
+// Register adds a job, replacing any job already registered under its name.
+func (s *BookScheduler) Register(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := s.cron.AddFunc(job.Schedule, func() { s.run(job) })
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q: %v", job.Schedule, err)
+	}
+
+	if old, ok := s.entries[job.Name]; ok {
+		s.cron.Remove(old)
+	}
+	s.jobs[job.Name] = job
+	s.entries[job.Name] = id
+	return nil
 }
 
 func (s *BookScheduler) Start() {
-	ticker := time.NewTicker(1 * time.Hour)
-	go func() {
-		for range ticker.C {
-			s.checkOverdueBooks()
+	s.cron.Start()
+	log.Printf("Scheduler started with %d jobs", len(s.jobs))
+}
+
+// Stop stops scheduling new runs, cancels the context of running jobs and
+// waits for them to finish or for ctx to expire.
+func (s *BookScheduler) Stop(ctx context.Context) {
+	done := s.cron.Stop()
+	s.cancel()
+
+	select {
+	case <-done.Done():
+		log.Printf("Scheduler stopped")
+	case <-ctx.Done():
+		log.Printf("Scheduler stop timed out: %v", ctx.Err())
+	}
+}
+
+// ListJobs reports each job's schedule, last run and next run.
+func (s *BookScheduler) ListJobs(ctx context.Context, req *pb.ListJobsRequest) (*pb.ListJobsResponse, error) {
+	if _, err := services.RequireAdmin(ctx, s.db); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	jobs := make([]Job, 0, len(s.jobs))
+	next := make(map[string]time.Time, len(s.jobs))
+	for name, job := range s.jobs {
+		jobs = append(jobs, job)
+		next[name] = s.cron.Entry(s.entries[name]).Next
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	resp := &pb.ListJobsResponse{}
+	for _, job := range jobs {
+		pbJob := &pb.Job{
+			Name:     job.Name,
+			Schedule: job.Schedule,
+		}
+		if !next[job.Name].IsZero() {
+			pbJob.NextRunAt = next[job.Name].Format(time.RFC3339)
 		}
-	}()
+
+		var last models.JobRun
+		err := s.db.Collection("job_runs").FindOne(
+			ctx,
+			bson.M{"job": job.Name},
+			options.FindOne().SetSort(bson.M{"started_at": -1}),
+		).Decode(&last)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.Internal, "failed to fetch run history")
+		}
+		if err == nil {
+			pbJob.LastRunAt = last.StartedAt.Format(time.RFC3339)
+			pbJob.LastStatus = last.Status
+			pbJob.LastMessage = last.Message
+			if last.Error != "" {
+				pbJob.LastMessage = last.Error
+			}
+		}
+
+		resp.Jobs = append(resp.Jobs, pbJob)
+	}
+
+	return resp, nil
 }
 
-func (s *BookScheduler) checkOverdueBooks() {
-	ctx := context.Background()
-	now := time.Now()
+// run executes a job and records the run in the job_runs collection.
+func (s *BookScheduler) run(job Job) {
+	run := models.JobRun{
+		Job:       job.Name,
+		Status:    models.JobRunRunning,
+		StartedAt: time.Now(),
+	}
 
-	filter := bson.M{
-		"return_date": nil,
-		"borrowed_date": bson.M{
-			"$lt": now.Add(-14 * 24 * time.Hour),
-		},
+	result, err := s.db.Collection("job_runs").InsertOne(s.ctx, run)
+	if err != nil {
+		log.Printf("Error recording start of job %s: %v", job.Name, err)
 	}
 
+	message, runErr := job.Run(s.ctx)
+
+	finishedAt := time.Now()
 	update := bson.M{
-		"$set": bson.M{"status": "overdue"},
+		"status":      models.JobRunSucceeded,
+		"message":     message,
+		"finished_at": finishedAt,
+	}
+	if runErr != nil {
+		update["status"] = models.JobRunFailed
+		update["error"] = runErr.Error()
+		log.Printf("Job %s failed: %v", job.Name, runErr)
+	} else {
+		log.Printf("Job %s: %s", job.Name, message)
 	}
 
-	result, err := s.db.Collection("borrowed_books").UpdateMany(ctx, filter, update)
-	if err != nil {
-		log.Printf("Error updating overdue books: %v", err)
+	if result == nil {
 		return
 	}
 
-	log.Printf("Updated %d overdue books", result.ModifiedCount)
+	// Record the outcome even if the scheduler is stopping.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = s.db.Collection("job_runs").UpdateOne(
+		ctx,
+		bson.M{"_id": result.InsertedID.(primitive.ObjectID)},
+		bson.M{"$set": update},
+	)
+	if err != nil {
+		log.Printf("Error recording result of job %s: %v", job.Name, err)
+	}
+}
+
+// checkOverdueBooks marks open loans past their due date as overdue, together
+// with the copies they lent out.
+func (s *BookScheduler) checkOverdueBooks(ctx context.Context) (string, error) {
+	cursor, err := s.db.Collection("borrowed_books").Find(ctx, bson.M{
+		"return_date": nil,
+		"due_date":    bson.M{"$lt": time.Now()},
+		"status":      bson.M{"$ne": models.LoanStatusOverdue},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var loans []models.BorrowedBook
+	if err := cursor.All(ctx, &loans); err != nil {
+		return "", err
+	}
+	if len(loans) == 0 {
+		return "no new overdue loans", nil
+	}
+
+	loanIDs := make(bson.A, 0, len(loans))
+	itemIDs := make(bson.A, 0, len(loans))
+	for _, loan := range loans {
+		loanIDs = append(loanIDs, loan.ID)
+		itemIDs = append(itemIDs, loan.ItemID)
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		result, err := s.db.Collection("borrowed_books").UpdateMany(
+			ctx,
+			bson.M{"_id": bson.M{"$in": loanIDs}, "return_date": nil},
+			bson.M{"$set": bson.M{"status": models.LoanStatusOverdue}},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = s.db.Collection("items").UpdateMany(
+			ctx,
+			bson.M{"_id": bson.M{"$in": itemIDs}, "status": models.ItemStatusBorrowed},
+			bson.M{"$set": bson.M{"status": models.ItemStatusOverdue}},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return result.ModifiedCount, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("marked %d loans overdue", result.(int64)), nil
+}
+
+func (s *BookScheduler) expireHolds(ctx context.Context) (string, error) {
+	expired, err := s.holdService.ExpireReadyHolds(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("expired %d uncollected holds", expired), nil
+}
+
+func (s *BookScheduler) accrueFines(ctx context.Context) (string, error) {
+	accrued, err := s.fineService.AccrueOverdueFines(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("accrued fines for %d overdue loans", accrued), nil
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	pb "gc-buku/proto"
+	"gc-buku/services"
+	"gc-buku/utils"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// publicMethods can be called without a token.
+var publicMethods = map[string]bool{
+	pb.BookService_CreateUser_FullMethodName: true,
+	pb.BookService_Login_FullMethodName:      true,
+	// These check the token they are given themselves.
+	pb.BookService_RefreshToken_FullMethodName:         true,
+	pb.BookService_RequestPasswordReset_FullMethodName: true,
+	pb.BookService_ResetPassword_FullMethodName:        true,
+	pb.BookService_VerifyEmail_FullMethodName:          true,
+}
+
+// methodPermissions is the permission each RPC requires; an empty permission
+// only requires a valid session. Methods missing from this map and from
+// publicMethods are denied.
+var methodPermissions = map[string]string{
+	pb.BookService_Logout_FullMethodName:          "",
+	pb.BookService_ValidateSession_FullMethodName: "",
+	// Users manage their own account; the service checks for admins
+	// acting on others.
+	pb.BookService_UpdateUser_FullMethodName:     "",
+	pb.BookService_ChangePassword_FullMethodName: "",
+	pb.BookService_DeleteUser_FullMethodName:     "",
+	pb.BookService_GetUser_FullMethodName:        utils.PermUsersRead,
+	pb.BookService_GetBook_FullMethodName:        utils.PermBooksRead,
+	pb.BookService_GetBookByISBN_FullMethodName:  utils.PermBooksRead,
+	pb.BookService_ListBooks_FullMethodName:      utils.PermBooksRead,
+	pb.BookService_SearchBooks_FullMethodName:    utils.PermBooksRead,
+	pb.BookService_CreateBook_FullMethodName:     utils.PermBooksWrite,
+	pb.BookService_UpdateBook_FullMethodName:     utils.PermBooksWrite,
+	pb.BookService_DeleteBook_FullMethodName:     utils.PermBooksWrite,
+	pb.BookService_ImportBooks_FullMethodName:    utils.PermBooksWrite,
+	pb.BookService_ImportMARC_FullMethodName:     utils.PermBooksWrite,
+	pb.BookService_ExportMARC_FullMethodName:     utils.PermBooksRead,
+	pb.BookService_ExportBooks_FullMethodName:    utils.PermBooksRead,
+	pb.BookService_CreateAuthor_FullMethodName:   utils.PermBooksWrite,
+	pb.BookService_GetAuthor_FullMethodName:      utils.PermBooksRead,
+	pb.BookService_ListAuthors_FullMethodName:    utils.PermBooksRead,
+	pb.BookService_MergeAuthors_FullMethodName:   utils.PermBooksWrite,
+	pb.BookService_CreateSubject_FullMethodName:  utils.PermBooksWrite,
+	pb.BookService_ListSubjects_FullMethodName:   utils.PermBooksRead,
+	pb.BookService_UpdateSubject_FullMethodName:  utils.PermBooksWrite,
+	pb.BookService_DeleteSubject_FullMethodName:  utils.PermBooksWrite,
+	pb.BookService_CreateItem_FullMethodName:     utils.PermBooksWrite,
+	pb.BookService_ListItems_FullMethodName:      utils.PermBooksRead,
+	pb.BookService_UpdateItem_FullMethodName:     utils.PermBooksWrite,
+	pb.BookService_DeleteItem_FullMethodName:     utils.PermBooksWrite,
+	pb.BookService_BorrowBook_FullMethodName:     utils.PermCirculation,
+	pb.BookService_ReturnBook_FullMethodName:     utils.PermCirculation,
+	pb.BookService_RenewLoan_FullMethodName:      utils.PermCirculation,
+	pb.BookService_ListLoans_FullMethodName:      utils.PermCirculation,
+	pb.BookService_PlaceHold_FullMethodName:      utils.PermCirculation,
+	pb.BookService_CancelHold_FullMethodName:     utils.PermCirculation,
+	pb.BookService_ListHolds_FullMethodName:      utils.PermCirculation,
+	pb.BookService_ListFines_FullMethodName:      utils.PermCirculation,
+	pb.BookService_PayFine_FullMethodName:        utils.PermFinesManage,
+	pb.BookService_WaiveFine_FullMethodName:      utils.PermFinesWaive,
+	pb.BookService_ListJobs_FullMethodName:       utils.PermJobsView,
+	pb.BookService_ListUsers_FullMethodName:      utils.PermUsersManage,
+	pb.BookService_UnlockUser_FullMethodName:     utils.PermUsersManage,
+	pb.BookService_GrantRole_FullMethodName:      utils.PermRolesManage,
+	pb.BookService_RevokeRole_FullMethodName:     utils.PermRolesManage,
+}
+
+// authenticator checks the caller of every RPC.
+type authenticator struct {
+	sessions *services.SessionService
+}
+
+// authenticate validates the bearer token in the call metadata, checks its
+// session has not been revoked and that it grants the permission the method
+// requires, and returns a context carrying the caller's identity.
+func (a *authenticator) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if publicMethods[method] {
+		return ctx, nil
+	}
+
+	perm, ok := methodPermissions[method]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "method %s is not permitted", method)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "missing authorization token")
+	}
+
+	claims, err := utils.ValidateToken(strings.TrimPrefix(values[0], "Bearer "))
+	if err != nil || claims == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token")
+	}
+
+	active, err := a.sessions.SessionActive(ctx, claims.SessionID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check session")
+	}
+	if !active {
+		return nil, status.Errorf(codes.Unauthenticated, "session revoked or expired")
+	}
+
+	if perm != "" && !utils.HasPermission(claims.Role, perm) {
+		return nil, status.Errorf(codes.PermissionDenied, "role %q lacks permission %s", claims.Role, perm)
+	}
+
+	return utils.WithIdentity(ctx, utils.Identity{
+		UserID:    claims.UserID,
+		Role:      claims.Role,
+		SessionID: claims.SessionID,
+	}), nil
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *authenticator) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream carries the caller's identity in its context.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -6,11 +6,18 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"gc-buku/mailer"
 	pb "gc-buku/proto"
+	"gc-buku/scheduler"
 	"gc-buku/services"
+	"gc-buku/utils"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/grpc"
@@ -18,9 +25,16 @@ import (
 
 type server struct {
 	pb.UnimplementedBookServiceServer
-	userService   *services.UserService
-	bookService   *services.BookService
-	borrowService *services.BorrowService
+	userService    *services.UserService
+	bookService    *services.BookService
+	borrowService  *services.BorrowService
+	holdService    *services.HoldService
+	fineService    *services.FineService
+	itemService    *services.ItemService
+	authorService  *services.AuthorService
+	subjectService *services.SubjectService
+	sessionService *services.SessionService
+	scheduler      *scheduler.BookScheduler
 }
 
 func (s *server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
@@ -31,10 +45,62 @@ func (s *server) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUs
 	return s.userService.GetUser(ctx, req)
 }
 
+func (s *server) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
+	return s.userService.UpdateUser(ctx, req)
+}
+
+func (s *server) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	return s.userService.ChangePassword(ctx, req)
+}
+
+func (s *server) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	return s.userService.DeleteUser(ctx, req)
+}
+
+func (s *server) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	return s.userService.ListUsers(ctx, req)
+}
+
 func (s *server) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
 	return s.userService.Login(ctx, req)
 }
 
+func (s *server) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	return s.sessionService.RefreshToken(ctx, req)
+}
+
+func (s *server) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	return s.sessionService.Logout(ctx, req)
+}
+
+func (s *server) ValidateSession(ctx context.Context, req *pb.ValidateSessionRequest) (*pb.ValidateSessionResponse, error) {
+	return s.sessionService.ValidateSession(ctx, req)
+}
+
+func (s *server) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	return s.userService.RequestPasswordReset(ctx, req)
+}
+
+func (s *server) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error) {
+	return s.userService.ResetPassword(ctx, req)
+}
+
+func (s *server) VerifyEmail(ctx context.Context, req *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+	return s.userService.VerifyEmail(ctx, req)
+}
+
+func (s *server) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	return s.userService.UnlockUser(ctx, req)
+}
+
+func (s *server) GrantRole(ctx context.Context, req *pb.GrantRoleRequest) (*pb.GrantRoleResponse, error) {
+	return s.userService.GrantRole(ctx, req)
+}
+
+func (s *server) RevokeRole(ctx context.Context, req *pb.RevokeRoleRequest) (*pb.RevokeRoleResponse, error) {
+	return s.userService.RevokeRole(ctx, req)
+}
+
 func (s *server) CreateBook(ctx context.Context, req *pb.CreateBookRequest) (*pb.CreateBookResponse, error) {
 	return s.bookService.CreateBook(ctx, req)
 }
@@ -43,6 +109,18 @@ func (s *server) GetBook(ctx context.Context, req *pb.GetBookRequest) (*pb.GetBo
 	return s.bookService.GetBook(ctx, req)
 }
 
+func (s *server) GetBookByISBN(ctx context.Context, req *pb.GetBookByISBNRequest) (*pb.GetBookByISBNResponse, error) {
+	return s.bookService.GetBookByISBN(ctx, req)
+}
+
+func (s *server) ListBooks(ctx context.Context, req *pb.ListBooksRequest) (*pb.ListBooksResponse, error) {
+	return s.bookService.ListBooks(ctx, req)
+}
+
+func (s *server) SearchBooks(ctx context.Context, req *pb.SearchBooksRequest) (*pb.SearchBooksResponse, error) {
+	return s.bookService.SearchBooks(ctx, req)
+}
+
 func (s *server) UpdateBook(ctx context.Context, req *pb.UpdateBookRequest) (*pb.UpdateBookResponse, error) {
 	return s.bookService.UpdateBook(ctx, req)
 }
@@ -51,6 +129,70 @@ func (s *server) DeleteBook(ctx context.Context, req *pb.DeleteBookRequest) (*pb
 	return s.bookService.DeleteBook(ctx, req)
 }
 
+func (s *server) ImportBooks(stream pb.BookService_ImportBooksServer) error {
+	return s.bookService.ImportBooks(stream)
+}
+
+func (s *server) ImportMARC(stream pb.BookService_ImportMARCServer) error {
+	return s.bookService.ImportMARC(stream)
+}
+
+func (s *server) ExportMARC(req *pb.ExportMARCRequest, stream pb.BookService_ExportMARCServer) error {
+	return s.bookService.ExportMARC(req, stream)
+}
+
+func (s *server) ExportBooks(req *pb.ExportBooksRequest, stream pb.BookService_ExportBooksServer) error {
+	return s.bookService.ExportBooks(req, stream)
+}
+
+func (s *server) CreateAuthor(ctx context.Context, req *pb.CreateAuthorRequest) (*pb.CreateAuthorResponse, error) {
+	return s.authorService.CreateAuthor(ctx, req)
+}
+
+func (s *server) GetAuthor(ctx context.Context, req *pb.GetAuthorRequest) (*pb.GetAuthorResponse, error) {
+	return s.authorService.GetAuthor(ctx, req)
+}
+
+func (s *server) ListAuthors(ctx context.Context, req *pb.ListAuthorsRequest) (*pb.ListAuthorsResponse, error) {
+	return s.authorService.ListAuthors(ctx, req)
+}
+
+func (s *server) MergeAuthors(ctx context.Context, req *pb.MergeAuthorsRequest) (*pb.MergeAuthorsResponse, error) {
+	return s.authorService.MergeAuthors(ctx, req)
+}
+
+func (s *server) CreateSubject(ctx context.Context, req *pb.CreateSubjectRequest) (*pb.CreateSubjectResponse, error) {
+	return s.subjectService.CreateSubject(ctx, req)
+}
+
+func (s *server) ListSubjects(ctx context.Context, req *pb.ListSubjectsRequest) (*pb.ListSubjectsResponse, error) {
+	return s.subjectService.ListSubjects(ctx, req)
+}
+
+func (s *server) UpdateSubject(ctx context.Context, req *pb.UpdateSubjectRequest) (*pb.UpdateSubjectResponse, error) {
+	return s.subjectService.UpdateSubject(ctx, req)
+}
+
+func (s *server) DeleteSubject(ctx context.Context, req *pb.DeleteSubjectRequest) (*pb.DeleteSubjectResponse, error) {
+	return s.subjectService.DeleteSubject(ctx, req)
+}
+
+func (s *server) CreateItem(ctx context.Context, req *pb.CreateItemRequest) (*pb.CreateItemResponse, error) {
+	return s.itemService.CreateItem(ctx, req)
+}
+
+func (s *server) ListItems(ctx context.Context, req *pb.ListItemsRequest) (*pb.ListItemsResponse, error) {
+	return s.itemService.ListItems(ctx, req)
+}
+
+func (s *server) UpdateItem(ctx context.Context, req *pb.UpdateItemRequest) (*pb.UpdateItemResponse, error) {
+	return s.itemService.UpdateItem(ctx, req)
+}
+
+func (s *server) DeleteItem(ctx context.Context, req *pb.DeleteItemRequest) (*pb.DeleteItemResponse, error) {
+	return s.itemService.DeleteItem(ctx, req)
+}
+
 func (s *server) BorrowBook(ctx context.Context, req *pb.BorrowBookRequest) (*pb.BorrowBookResponse, error) {
 	return s.borrowService.BorrowBook(ctx, req)
 }
@@ -59,6 +201,42 @@ func (s *server) ReturnBook(ctx context.Context, req *pb.ReturnBookRequest) (*pb
 	return s.borrowService.ReturnBook(ctx, req)
 }
 
+func (s *server) RenewLoan(ctx context.Context, req *pb.RenewLoanRequest) (*pb.RenewLoanResponse, error) {
+	return s.borrowService.RenewLoan(ctx, req)
+}
+
+func (s *server) ListLoans(ctx context.Context, req *pb.ListLoansRequest) (*pb.ListLoansResponse, error) {
+	return s.borrowService.ListLoans(ctx, req)
+}
+
+func (s *server) PlaceHold(ctx context.Context, req *pb.PlaceHoldRequest) (*pb.PlaceHoldResponse, error) {
+	return s.holdService.PlaceHold(ctx, req)
+}
+
+func (s *server) CancelHold(ctx context.Context, req *pb.CancelHoldRequest) (*pb.CancelHoldResponse, error) {
+	return s.holdService.CancelHold(ctx, req)
+}
+
+func (s *server) ListHolds(ctx context.Context, req *pb.ListHoldsRequest) (*pb.ListHoldsResponse, error) {
+	return s.holdService.ListHolds(ctx, req)
+}
+
+func (s *server) ListFines(ctx context.Context, req *pb.ListFinesRequest) (*pb.ListFinesResponse, error) {
+	return s.fineService.ListFines(ctx, req)
+}
+
+func (s *server) PayFine(ctx context.Context, req *pb.PayFineRequest) (*pb.PayFineResponse, error) {
+	return s.fineService.PayFine(ctx, req)
+}
+
+func (s *server) WaiveFine(ctx context.Context, req *pb.WaiveFineRequest) (*pb.WaiveFineResponse, error) {
+	return s.fineService.WaiveFine(ctx, req)
+}
+
+func (s *server) ListJobs(ctx context.Context, req *pb.ListJobsRequest) (*pb.ListJobsResponse, error) {
+	return s.scheduler.ListJobs(ctx, req)
+}
+
 func initDB(mongoURI, dbName string) (*mongo.Database, error) {
 	ctx := context.TODO()
 
@@ -74,7 +252,7 @@ func initDB(mongoURI, dbName string) (*mongo.Database, error) {
 
 	db := client.Database(dbName)
 
-	collections := []string{"users", "books", "borrowed_books"}
+	collections := []string{"users", "books", "borrowed_books", "loan_policies", "holds", "fines", "job_runs", "sessions", "user_tokens", "login_attempts", "items", "schema_migrations", "authors", "subjects"}
 	for _, col := range collections {
 		if err := db.CreateCollection(ctx, col); err != nil {
 			if !strings.Contains(err.Error(), "already exists") {
@@ -83,11 +261,156 @@ func initDB(mongoURI, dbName string) (*mongo.Database, error) {
 		}
 	}
 
+	// Migrations run first, so that they can fix data the indexes below
+	// would reject.
+	if err := services.RunMigrations(ctx, db); err != nil {
+		return nil, fmt.Errorf("failed to migrate: %v", err)
+	}
+
+	indexes := map[string][]mongo.IndexModel{
+		"users": {
+			// Case-insensitive, so "Alice" cannot register next to "alice".
+			{
+				Keys: bson.D{{Key: "username", Value: 1}},
+				Options: options.Index().
+					SetUnique(true).
+					SetCollation(&options.Collation{Locale: "en", Strength: 2}),
+			},
+			{
+				Keys: bson.D{{Key: "email", Value: 1}},
+				Options: options.Index().
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}}),
+			},
+		},
+		"books": {
+			{
+				Keys: bson.D{{Key: "title", Value: "text"}, {Key: "author", Value: "text"}},
+				Options: options.Index().
+					SetName("books_text").
+					SetWeights(bson.D{{Key: "title", Value: 2}, {Key: "author", Value: 1}}),
+			},
+			{
+				Keys: bson.D{{Key: "isbn", Value: 1}},
+				Options: options.Index().
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"isbn": bson.M{"$type": "string"}}),
+			},
+			{
+				Keys: bson.D{{Key: "external_id", Value: 1}},
+				Options: options.Index().
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"external_id": bson.M{"$type": "string"}}),
+			},
+			{Keys: bson.D{{Key: "contributors.author_id", Value: 1}}},
+			{Keys: bson.D{{Key: "subject_ids", Value: 1}}},
+			{Keys: bson.D{{Key: "tags", Value: 1}}},
+		},
+		// Sibling subjects have distinct names, ignoring case.
+		"subjects": {
+			{
+				Keys: bson.D{{Key: "parent_id", Value: 1}, {Key: "name", Value: 1}},
+				Options: options.Index().
+					SetUnique(true).
+					SetCollation(&options.Collation{Locale: "en", Strength: 2}),
+			},
+			{Keys: bson.D{{Key: "ancestors", Value: 1}}},
+		},
+		// Case-insensitive, matching how authors are looked up by name.
+		// Names are unique, so that concurrent lookups create one author.
+		"authors": {
+			{
+				Keys: bson.D{{Key: "name", Value: 1}},
+				Options: options.Index().
+					SetUnique(true).
+					SetCollation(&options.Collation{Locale: "en", Strength: 2}),
+			},
+			{
+				Keys:    bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}},
+				Options: options.Index().SetCollation(&options.Collation{Locale: "en", Strength: 2}),
+			},
+			{
+				Keys:    bson.D{{Key: "aliases", Value: 1}},
+				Options: options.Index().SetCollation(&options.Collation{Locale: "en", Strength: 2}),
+			},
+		},
+		"items": {
+			{
+				Keys:    bson.D{{Key: "barcode", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "title_id", Value: 1}, {Key: "status", Value: 1}}},
+		},
+		"loan_policies": {
+			{
+				Keys:    bson.D{{Key: "scope", Value: 1}, {Key: "key", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		"borrowed_books": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "borrowed_date", Value: -1}}},
+			{Keys: bson.D{{Key: "book_id", Value: 1}, {Key: "borrowed_date", Value: -1}}},
+		},
+		"holds": {
+			{Keys: bson.D{{Key: "book_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}}},
+		},
+		"fines": {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}}},
+			{
+				Keys: bson.D{{Key: "loan_id", Value: 1}, {Key: "type", Value: 1}},
+				Options: options.Index().
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"loan_id": bson.M{"$exists": true}}),
+			},
+		},
+		"job_runs": {
+			{Keys: bson.D{{Key: "job", Value: 1}, {Key: "started_at", Value: -1}}},
+		},
+		"sessions": {
+			{
+				Keys:    bson.D{{Key: "refresh_token_hash", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			// Let MongoDB remove sessions once they expire.
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+		},
+		"login_attempts": {
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+		},
+		"user_tokens": {
+			{
+				Keys:    bson.D{{Key: "token_hash", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			},
+		},
+	}
+	for col, models := range indexes {
+		if _, err := db.Collection(col).Indexes().CreateMany(ctx, models); err != nil {
+			return nil, fmt.Errorf("failed to create indexes on %s: %v", col, err)
+		}
+	}
+
 	log.Printf("Connected to MongoDB: %s", dbName)
 	return db, nil
 }
 
 func main() {
+	if err := utils.ConfigureJWTFromEnv(); err != nil {
+		log.Fatalf("Failed to configure JWT: %v", err)
+	}
+
 	mongoURI := os.Getenv("MONGO_URI")
 	if mongoURI == "" {
 		mongoURI = "mongodb://localhost:27017"
@@ -103,22 +426,73 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	if os.Getenv("MAIL_DRIVER") == "" {
+		log.Printf("WARNING: MAIL_DRIVER is not set, emails are kept in memory and never delivered")
+	}
+	mail, err := mailer.FromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		appURL = "http://localhost:8081"
+	}
+
+	gatewaySecret := os.Getenv("GATEWAY_SECRET")
+	if gatewaySecret == "" {
+		log.Printf("WARNING: GATEWAY_SECRET is not set, failed logins are throttled per username only, not per client IP")
+	}
+
+	bookScheduler := scheduler.NewBookScheduler(db)
+
 	srv := &server{
-		userService:   services.NewUserService(db),
-		bookService:   services.NewBookService(db),
-		borrowService: services.NewBorrowService(db),
+		userService:    services.NewUserService(db, mail, appURL, gatewaySecret),
+		bookService:    services.NewBookService(db),
+		borrowService:  services.NewBorrowService(db),
+		holdService:    services.NewHoldService(db),
+		fineService:    services.NewFineService(db),
+		itemService:    services.NewItemService(db),
+		authorService:  services.NewAuthorService(db),
+		subjectService: services.NewSubjectService(db),
+		sessionService: services.NewSessionService(db),
+		scheduler:      bookScheduler,
 	}
+	auth := &authenticator{sessions: srv.sessionService}
 
 	lis, err := net.Listen("tcp", ":50051")
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(auth.unaryInterceptor),
+		grpc.StreamInterceptor(auth.streamInterceptor),
+	)
 	pb.RegisterBookServiceServer(s, srv)
 
-	log.Printf("gRPC Server listening on :50051")
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+	bookScheduler.Start()
+
+	go func() {
+		log.Printf("gRPC Server listening on :50051")
+		if err := s.Serve(lis); err != nil {
+			log.Fatalf("Failed to serve: %v", err)
+		}
+	}()
+
+	// Wait for interrupt signal to gracefully shut down the server
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Printf("Shutting down server...")
+	s.GracefulStop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	bookScheduler.Stop(ctx)
+
+	if err := db.Client().Disconnect(ctx); err != nil {
+		log.Printf("Failed to disconnect from MongoDB: %v", err)
 	}
 }
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"context"
+
+	"gc-buku/models"
+	"gc-buku/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// callerID returns the ID of the authenticated user making the call.
+func callerID(ctx context.Context) (primitive.ObjectID, error) {
+	identity, ok := utils.IdentityFromContext(ctx)
+	if !ok {
+		return primitive.NilObjectID, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+
+	userID, err := primitive.ObjectIDFromHex(identity.UserID)
+	if err != nil {
+		return primitive.NilObjectID, status.Errorf(codes.Unauthenticated, "invalid caller identity")
+	}
+	return userID, nil
+}
+
+// callerCan reports whether the authenticated caller's role grants perm.
+func callerCan(ctx context.Context, perm string) bool {
+	identity, ok := utils.IdentityFromContext(ctx)
+	return ok && utils.HasPermission(identity.Role, perm)
+}
+
+// RequireAdmin returns PermissionDenied unless the caller is currently an
+// admin. The role is read from the database rather than the token so a
+// revoked admin loses access straight away.
+func RequireAdmin(ctx context.Context, db *mongo.Database) (primitive.ObjectID, error) {
+	adminID, err := callerID(ctx)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	var admin models.User
+	err = db.Collection("users").FindOne(ctx, bson.M{"_id": adminID}).Decode(&admin)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return primitive.NilObjectID, status.Errorf(codes.PermissionDenied, "admin role required")
+		}
+		return primitive.NilObjectID, status.Errorf(codes.Internal, "failed to fetch user")
+	}
+	if admin.Role != models.RoleAdmin {
+		return primitive.NilObjectID, status.Errorf(codes.PermissionDenied, "admin role required")
+	}
+
+	return adminID, nil
+}
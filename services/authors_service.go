@@ -0,0 +1,463 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultAuthorPageSize = 20
+	maxAuthorPageSize     = 100
+
+	maxAuthorBioLength = 5000
+)
+
+// authorCollation compares author names ignoring case, so "tolkien" finds
+// "Tolkien". The authors indexes use the same collation.
+var authorCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// authorPageToken is the decoded form of the opaque ListAuthors page token:
+// the name and _id of the last author returned.
+type authorPageToken struct {
+	Name string             `bson:"n"`
+	ID   primitive.ObjectID `bson:"i"`
+}
+
+type AuthorService struct {
+	db *mongo.Database
+}
+
+func NewAuthorService(db *mongo.Database) *AuthorService {
+	return &AuthorService{db: db}
+}
+
+func (s *AuthorService) CreateAuthor(ctx context.Context, req *pb.CreateAuthorRequest) (*pb.CreateAuthorResponse, error) {
+	if req.Author == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "author is required")
+	}
+
+	author := models.Author{
+		Name:      strings.TrimSpace(req.Author.Name),
+		Bio:       strings.TrimSpace(req.Author.Bio),
+		CreatedAt: time.Now(),
+	}
+	for _, alias := range req.Author.Aliases {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			author.Aliases = append(author.Aliases, alias)
+		}
+	}
+
+	var violations fieldViolations
+	validateAuthorName(&violations, "author.name", author.Name)
+	for i, alias := range author.Aliases {
+		validateAuthorName(&violations, fmt.Sprintf("author.aliases[%d]", i), alias)
+	}
+	if len(author.Bio) > maxAuthorBioLength {
+		violations.add("author.bio", "bio must be at most 5000 characters")
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.Collection("authors").InsertOne(ctx, author)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, status.Errorf(codes.AlreadyExists, "author %q already exists", author.Name)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to create author")
+	}
+	author.ID = result.InsertedID.(primitive.ObjectID)
+
+	return &pb.CreateAuthorResponse{Author: authorToProto(author)}, nil
+}
+
+func (s *AuthorService) GetAuthor(ctx context.Context, req *pb.GetAuthorRequest) (*pb.GetAuthorResponse, error) {
+	authorID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid author ID")
+	}
+
+	var author models.Author
+	if err := s.db.Collection("authors").FindOne(ctx, bson.M{"_id": authorID}).Decode(&author); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.NotFound, "author not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to fetch author")
+	}
+
+	return &pb.GetAuthorResponse{Author: authorToProto(author)}, nil
+}
+
+func (s *AuthorService) ListAuthors(ctx context.Context, req *pb.ListAuthorsRequest) (*pb.ListAuthorsResponse, error) {
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultAuthorPageSize
+	}
+	if pageSize > maxAuthorPageSize {
+		pageSize = maxAuthorPageSize
+	}
+
+	conditions := bson.A{}
+	if query := strings.TrimSpace(req.Query); query != "" {
+		pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query), Options: "i"}
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			bson.M{"name": pattern},
+			bson.M{"aliases": pattern},
+		}})
+	}
+	if req.PageToken != "" {
+		token, err := decodeAuthorPageToken(req.PageToken)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+		}
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			bson.M{"name": bson.M{"$gt": token.Name}},
+			bson.M{"name": token.Name, "_id": bson.M{"$gt": token.ID}},
+		}})
+	}
+	filter := bson.M{}
+	if len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+
+	// Fetch one extra document to find out whether another page exists.
+	opts := options.Find().
+		SetCollation(authorCollation).
+		SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(pageSize + 1))
+	cursor, err := s.db.Collection("authors").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list authors")
+	}
+
+	var authors []models.Author
+	if err := cursor.All(ctx, &authors); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode authors")
+	}
+
+	resp := &pb.ListAuthorsResponse{}
+	if len(authors) > pageSize {
+		authors = authors[:pageSize]
+		last := authors[len(authors)-1]
+		resp.NextPageToken, err = encodeAuthorPageToken(authorPageToken{Name: last.Name, ID: last.ID})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode page token")
+		}
+	}
+	for _, author := range authors {
+		resp.Authors = append(resp.Authors, authorToProto(author))
+	}
+
+	return resp, nil
+}
+
+// MergeAuthors folds duplicate authors into one. Books crediting a duplicate
+// are credited to the target instead, the duplicates' names are kept as
+// aliases of the target, and the duplicates are deleted.
+func (s *AuthorService) MergeAuthors(ctx context.Context, req *pb.MergeAuthorsRequest) (*pb.MergeAuthorsResponse, error) {
+	targetID, err := primitive.ObjectIDFromHex(req.TargetId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid target author ID")
+	}
+	if len(req.SourceIds) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "at least one source author is required")
+	}
+
+	sourceIDs := make(bson.A, 0, len(req.SourceIds))
+	isSource := make(map[primitive.ObjectID]bool)
+	for _, id := range req.SourceIds {
+		sourceID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid source author ID %q", id)
+		}
+		if sourceID == targetID {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot merge an author into itself")
+		}
+		if !isSource[sourceID] {
+			isSource[sourceID] = true
+			sourceIDs = append(sourceIDs, sourceID)
+		}
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	var target models.Author
+	var booksUpdated int
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		target, booksUpdated = models.Author{}, 0
+		if err := s.db.Collection("authors").FindOne(ctx, bson.M{"_id": targetID}).Decode(&target); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.NotFound, "target author not found")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to fetch author")
+		}
+
+		cursor, err := s.db.Collection("authors").Find(ctx, bson.M{"_id": bson.M{"$in": sourceIDs}})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch authors")
+		}
+		var sources []models.Author
+		if err := cursor.All(ctx, &sources); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to decode authors")
+		}
+		if len(sources) != len(sourceIDs) {
+			return nil, status.Errorf(codes.NotFound, "source author not found")
+		}
+
+		cursor, err = s.db.Collection("books").Find(ctx, bson.M{"contributors.author_id": bson.M{"$in": sourceIDs}})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch books")
+		}
+		var books []models.Title
+		if err := cursor.All(ctx, &books); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to decode books")
+		}
+
+		for _, book := range books {
+			contributors := make([]models.Contributor, 0, len(book.Contributors))
+			for _, c := range book.Contributors {
+				if isSource[c.AuthorID] {
+					c.AuthorID = target.ID
+					c.Name = target.Name
+				}
+				contributors = appendContributor(contributors, c)
+			}
+
+			_, err := s.db.Collection("books").UpdateOne(ctx, bson.M{"_id": book.ID}, bson.M{"$set": bson.M{
+				"contributors": contributors,
+				"author":       contributorsDisplay(contributors),
+			}})
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to update books")
+			}
+			booksUpdated++
+		}
+
+		for _, source := range sources {
+			target.Aliases = appendAlias(target.Aliases, target.Name, source.Name)
+			for _, alias := range source.Aliases {
+				target.Aliases = appendAlias(target.Aliases, target.Name, alias)
+			}
+		}
+		_, err = s.db.Collection("authors").UpdateOne(ctx, bson.M{"_id": targetID}, bson.M{
+			"$set": bson.M{"aliases": target.Aliases},
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update author")
+		}
+
+		if _, err := s.db.Collection("authors").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": sourceIDs}}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete merged authors")
+		}
+		return nil, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.MergeAuthorsResponse{
+		Author:       authorToProto(target),
+		BooksUpdated: int32(booksUpdated),
+	}, nil
+}
+
+// resolveContributors works out who is credited on book: the authors it
+// references by ID or, for clients that only send an author string, the
+// author of that name, created if there is none yet.
+func resolveContributors(ctx context.Context, db *mongo.Database, field string, book *pb.Book) ([]models.Contributor, error) {
+	if len(book.Contributors) == 0 {
+		name := strings.TrimSpace(book.Author)
+		if name == "" {
+			return nil, nil
+		}
+
+		var violations fieldViolations
+		validateAuthorName(&violations, field+".author", name)
+		if err := violations.err(); err != nil {
+			return nil, err
+		}
+
+		author, err := findOrCreateAuthor(ctx, db, name)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resolve author")
+		}
+		return []models.Contributor{{AuthorID: author.ID, Name: author.Name, Role: models.ContributorRoleAuthor}}, nil
+	}
+
+	var violations fieldViolations
+	ids := make([]primitive.ObjectID, len(book.Contributors))
+	lookup := make(bson.A, 0, len(book.Contributors))
+	for i, c := range book.Contributors {
+		prefix := fmt.Sprintf("%s.contributors[%d]", field, i)
+		id, err := primitive.ObjectIDFromHex(c.AuthorId)
+		if err != nil {
+			violations.add(prefix+".author_id", "invalid author ID")
+		}
+		ids[i] = id
+		lookup = append(lookup, id)
+		validateContributorRole(&violations, prefix+".role", c.Role)
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	cursor, err := db.Collection("authors").Find(ctx, bson.M{"_id": bson.M{"$in": lookup}})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch authors")
+	}
+	var found []models.Author
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode authors")
+	}
+	authors := make(map[primitive.ObjectID]models.Author, len(found))
+	for _, author := range found {
+		authors[author.ID] = author
+	}
+
+	contributors := make([]models.Contributor, 0, len(book.Contributors))
+	for i, c := range book.Contributors {
+		author, ok := authors[ids[i]]
+		if !ok {
+			violations.add(fmt.Sprintf("%s.contributors[%d].author_id", field, i), "author not found")
+			continue
+		}
+		role := c.Role
+		if role == "" {
+			role = models.ContributorRoleAuthor
+		}
+		contributors = appendContributor(contributors, models.Contributor{AuthorID: author.ID, Name: author.Name, Role: role})
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+	return contributors, nil
+}
+
+// findOrCreateAuthor returns the author whose name or alias is name, ignoring
+// case, creating one if there is none. If another request creates the author
+// first, that author is returned.
+func findOrCreateAuthor(ctx context.Context, db *mongo.Database, name string) (models.Author, error) {
+	var author models.Author
+	err := db.Collection("authors").FindOne(
+		ctx,
+		bson.M{"$or": bson.A{bson.M{"name": name}, bson.M{"aliases": name}}},
+		options.FindOne().SetCollation(authorCollation).SetSort(bson.M{"_id": 1}),
+	).Decode(&author)
+	if err != mongo.ErrNoDocuments {
+		return author, err
+	}
+
+	author = models.Author{Name: name, CreatedAt: time.Now()}
+	result, err := db.Collection("authors").InsertOne(ctx, author)
+	if mongo.IsDuplicateKeyError(err) {
+		err = db.Collection("authors").FindOne(
+			ctx,
+			bson.M{"name": name},
+			options.FindOne().SetCollation(authorCollation),
+		).Decode(&author)
+		return author, err
+	}
+	if err != nil {
+		return author, err
+	}
+	author.ID = result.InsertedID.(primitive.ObjectID)
+	return author, nil
+}
+
+// contributorsDisplay renders contributors as the single author string, e.g.
+// "Ursula K. Le Guin, Jane Doe (translator)".
+func contributorsDisplay(contributors []models.Contributor) string {
+	names := make([]string, 0, len(contributors))
+	for _, c := range contributors {
+		if c.Role == models.ContributorRoleAuthor {
+			names = append(names, c.Name)
+		} else {
+			names = append(names, fmt.Sprintf("%s (%s)", c.Name, c.Role))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// appendContributor appends c unless the author is already credited in the
+// same role.
+func appendContributor(contributors []models.Contributor, c models.Contributor) []models.Contributor {
+	for _, existing := range contributors {
+		if existing.AuthorID == c.AuthorID && existing.Role == c.Role {
+			return contributors
+		}
+	}
+	return append(contributors, c)
+}
+
+// appendAlias appends alias unless it is the name or already an alias,
+// ignoring case.
+func appendAlias(aliases []string, name, alias string) []string {
+	if strings.EqualFold(alias, name) {
+		return aliases
+	}
+	for _, existing := range aliases {
+		if strings.EqualFold(existing, alias) {
+			return aliases
+		}
+	}
+	return append(aliases, alias)
+}
+
+func authorToProto(author models.Author) *pb.Author {
+	return &pb.Author{
+		Id:        author.ID.Hex(),
+		Name:      author.Name,
+		Aliases:   author.Aliases,
+		Bio:       author.Bio,
+		CreatedAt: author.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+func contributorsToProto(contributors []models.Contributor) []*pb.Contributor {
+	resp := make([]*pb.Contributor, 0, len(contributors))
+	for _, c := range contributors {
+		resp = append(resp, &pb.Contributor{
+			AuthorId: c.AuthorID.Hex(),
+			Name:     c.Name,
+			Role:     c.Role,
+		})
+	}
+	return resp
+}
+
+func encodeAuthorPageToken(token authorPageToken) (string, error) {
+	data, err := bson.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeAuthorPageToken(s string) (authorPageToken, error) {
+	var token authorPageToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return token, err
+	}
+	err = bson.Unmarshal(data, &token)
+	return token, err
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// snapshotTooOldCode is the server error for a snapshot read made after the
+// snapshot has expired, by default five minutes after it was taken.
+const snapshotTooOldCode = 239
+
+// ExportBooks streams every book, in ID order, as it was when the export
+// started.
+func (s *BookService) ExportBooks(req *pb.ExportBooksRequest, stream pb.BookService_ExportBooksServer) error {
+	return s.eachExportedBook(stream.Context(), func(book models.Title, subjects []string) error {
+		return stream.Send(&pb.ExportBooksResponse{Book: bookToProto(book), Subjects: subjects})
+	})
+}
+
+// eachExportedBook calls fn with every book, in ID order, and the paths of
+// its subjects. All reads share a snapshot, so books changed while the
+// export runs are seen as they were when it started. An error from fn stops
+// the export and is returned as is.
+func (s *BookService) eachExportedBook(ctx context.Context, fn func(book models.Title, subjects []string) error) error {
+	session, err := s.db.Client().StartSession(options.Session().SetSnapshot(true))
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to start export")
+	}
+	defer session.EndSession(ctx)
+	sctx := mongo.NewSessionContext(ctx, session)
+
+	paths, err := subjectPaths(sctx, s.db)
+	if err != nil {
+		return exportReadError(err, "failed to fetch subjects")
+	}
+
+	cursor, err := s.db.Collection("books").Find(sctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return exportReadError(err, "failed to list books")
+	}
+	defer cursor.Close(sctx)
+
+	for cursor.Next(sctx) {
+		var book models.Title
+		if err := cursor.Decode(&book); err != nil {
+			return status.Errorf(codes.Internal, "failed to decode book")
+		}
+		var subjects []string
+		for _, id := range book.SubjectIDs {
+			if path, ok := paths[id]; ok {
+				subjects = append(subjects, path)
+			}
+		}
+		if err := fn(book, subjects); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return exportReadError(err, "failed to list books")
+	}
+	return nil
+}
+
+// exportReadError reports a failed read of an export, telling apart the
+// snapshot expiring under a slow reader.
+func exportReadError(err error, msg string) error {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(snapshotTooOldCode) {
+		return status.Errorf(codes.Aborted, "export took too long to read from one snapshot")
+	}
+	return status.Error(codes.Internal, msg)
+}
+
+// subjectPaths returns the path of every subject, such as
+// "Science -- Physics", by ID.
+func subjectPaths(ctx context.Context, db *mongo.Database) (map[primitive.ObjectID]string, error) {
+	cursor, err := db.Collection("subjects").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var subjects []models.Subject
+	if err := cursor.All(ctx, &subjects); err != nil {
+		return nil, err
+	}
+
+	names := make(map[primitive.ObjectID]string, len(subjects))
+	for _, subject := range subjects {
+		names[subject.ID] = subject.Name
+	}
+
+	paths := make(map[primitive.ObjectID]string, len(subjects))
+	for _, subject := range subjects {
+		parts := make([]string, 0, len(subject.Ancestors)+1)
+		for _, id := range subject.Ancestors {
+			parts = append(parts, names[id])
+		}
+		paths[subject.ID] = strings.Join(append(parts, subject.Name), subjectPathSeparator)
+	}
+	return paths, nil
+}
@@ -0,0 +1,477 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+	"gc-buku/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Outcomes of importing a row.
+const (
+	importCreated = "created"
+	importUpdated = "updated"
+	importSkipped = "skipped"
+	importError   = "error"
+)
+
+// maxImportCopies caps the copies a single imported row can add.
+const maxImportCopies = 100
+
+// importRow is one book in an import file. CSV columns and JSONL keys have
+// the same names; in CSV, list values are separated by semicolons and
+// contributors cannot be given. Other columns and keys are ignored, so
+// exported files can be imported again.
+type importRow struct {
+	ExternalID string `json:"external_id"`
+	Title      string `json:"title"`
+	Author     string `json:"author"`
+	// Contributors credit authors by name, who are created if needed. They
+	// take precedence over author.
+	Contributors  []importContributor `json:"contributors"`
+	ISBN          string              `json:"isbn"`
+	Description   string              `json:"description"`
+	PublishedDate string              `json:"published_date"`
+	Category      string              `json:"category"`
+	SubjectIDs    []string            `json:"subject_ids"`
+	// Subjects file the book by subject path, such as "Science -- Physics",
+	// creating subjects as needed.
+	Subjects []string `json:"subjects"`
+	Tags     []string `json:"tags"`
+	Dewey    string   `json:"dewey"`
+	LCC      string   `json:"lcc"`
+	// The copies to add when the book is created: one per barcode, topped
+	// up to copies with generated barcodes.
+	Copies   int      `json:"copies"`
+	Barcodes []string `json:"barcodes"`
+}
+
+type importContributor struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// importDecoder reads the rows of an import file. Problems with a single
+// row are returned as a *rowError so the import can carry on with the next
+// row; any other error ends it.
+type importDecoder interface {
+	next() (line int, row importRow, err error)
+}
+
+// rowError is a problem with a single row of an import file.
+type rowError struct {
+	msg string
+}
+
+func (e *rowError) Error() string { return e.msg }
+
+// ImportBooks creates or updates a book for each row of a CSV or JSONL file
+// streamed by the client. Books are matched by external ID, then by ISBN.
+// Every row is imported on its own, so a bad row is reported and skipped
+// rather than failing the import.
+func (s *BookService) ImportBooks(stream pb.BookService_ImportBooksServer) error {
+	ctx := stream.Context()
+
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Errorf(codes.InvalidArgument, "no file given")
+	}
+	if err != nil {
+		return err
+	}
+
+	in := &importStreamReader{buf: first.Data, recv: func() ([]byte, error) {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return req.Data, nil
+	}}
+	var decoder importDecoder
+	switch first.Format {
+	case "csv":
+		if decoder, err = newCSVImportDecoder(in); err != nil {
+			return err
+		}
+	case "jsonl":
+		decoder = newJSONLImportDecoder(in)
+	default:
+		return status.Errorf(codes.InvalidArgument, "format must be csv or jsonl")
+	}
+
+	resp, err := s.importRows(ctx, decoder, first.SkipExisting)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+// importRows imports every row decoder reads.
+func (s *BookService) importRows(ctx context.Context, decoder importDecoder, skipExisting bool) (*pb.ImportBooksResponse, error) {
+	resp := &pb.ImportBooksResponse{}
+	for {
+		line, row, err := decoder.next()
+		if err == io.EOF {
+			break
+		}
+
+		var result *pb.ImportBookResult
+		var rowErr *rowError
+		switch {
+		case errors.As(err, &rowErr):
+			result = &pb.ImportBookResult{Status: importError, Error: rowErr.msg}
+		case err != nil:
+			return nil, status.Errorf(codes.InvalidArgument, "failed to read line %d: %v", line, err)
+		default:
+			result = s.importBook(ctx, row, skipExisting)
+		}
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+
+		result.Line = int32(line)
+		switch result.Status {
+		case importCreated:
+			resp.Created++
+		case importUpdated:
+			resp.Updated++
+		case importSkipped:
+			resp.Skipped++
+		default:
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	return resp, nil
+}
+
+// importBook creates or updates the book described by row.
+func (s *BookService) importBook(ctx context.Context, row importRow, skipExisting bool) *pb.ImportBookResult {
+	result := &pb.ImportBookResult{ExternalId: strings.TrimSpace(row.ExternalID)}
+	fail := func(err error) *pb.ImportBookResult {
+		result.Status = importError
+		result.Error = status.Convert(err).Message()
+		return result
+	}
+
+	if strings.TrimSpace(row.Title) == "" {
+		return fail(status.Errorf(codes.InvalidArgument, "title is required"))
+	}
+	var isbn string
+	if row.ISBN != "" {
+		var err error
+		if isbn, err = utils.NormalizeISBN(row.ISBN); err != nil {
+			return fail(status.Errorf(codes.InvalidArgument, "invalid ISBN: %v", err))
+		}
+	}
+	result.Isbn_13 = isbn
+
+	book := &pb.Book{
+		Title:         strings.TrimSpace(row.Title),
+		Author:        strings.TrimSpace(row.Author),
+		ExternalId:    result.ExternalId,
+		Isbn_13:       isbn,
+		Description:   row.Description,
+		PublishedDate: row.PublishedDate,
+		Category:      row.Category,
+		SubjectIds:    row.SubjectIDs,
+		Tags:          row.Tags,
+		Dewey:         row.Dewey,
+		Lcc:           row.LCC,
+	}
+
+	existing, err := s.findImportedBook(ctx, book.ExternalId, isbn)
+	if err != nil {
+		return fail(err)
+	}
+	if existing != nil && skipExisting {
+		result.Status = importSkipped
+		result.BookId = existing.ID.Hex()
+		return result
+	}
+	var items []*pb.Item
+	if existing == nil {
+		if items, err = importItems(row); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Contributors are credited by name, so CreateBook and UpdateBook
+	// cannot check them.
+	var contributors []importContributor
+	for _, c := range row.Contributors {
+		name := strings.TrimSpace(c.Name)
+		role := strings.ToLower(strings.TrimSpace(c.Role))
+		switch role {
+		case "":
+			role = models.ContributorRoleAuthor
+		case models.ContributorRoleAuthor, models.ContributorRoleEditor, models.ContributorRoleTranslator:
+		default:
+			// Roles the catalog does not credit, such as illustrator, are
+			// left out.
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		if len(name) > maxAuthorNameLength {
+			return fail(status.Errorf(codes.InvalidArgument, "contributor name must be at most %d characters", maxAuthorNameLength))
+		}
+		contributors = append(contributors, importContributor{Name: name, Role: role})
+	}
+
+	if existing != nil {
+		result.BookId = existing.ID.Hex()
+		// A row matched on one identifier keeps the other.
+		if book.ExternalId == "" {
+			book.ExternalId = existing.ExternalID
+		}
+		if book.Isbn_13 == "" {
+			book.Isbn_13 = existing.ISBN
+		}
+		book.Id = existing.ID.Hex()
+	}
+
+	// Authors and subjects are created in the same transaction as the book,
+	// so that a row that fails leaves none behind.
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return fail(status.Errorf(codes.Internal, "failed to start transaction"))
+	}
+	defer session.EndSession(ctx)
+
+	bookID, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		book.Contributors = nil
+		for _, c := range contributors {
+			author, err := findOrCreateAuthor(ctx, s.db, c.Name)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to resolve author")
+			}
+			book.Contributors = append(book.Contributors, &pb.Contributor{AuthorId: author.ID.Hex(), Role: c.Role})
+		}
+
+		book.SubjectIds = append([]string{}, row.SubjectIDs...)
+		for _, path := range row.Subjects {
+			subject, err := findOrCreateSubject(ctx, s.db, path)
+			if err != nil {
+				return nil, err
+			}
+			if !subject.IsZero() {
+				book.SubjectIds = append(book.SubjectIds, subject.Hex())
+			}
+		}
+
+		if existing == nil {
+			resp, err := s.createBook(ctx, &pb.CreateBookRequest{Book: book, Items: items})
+			if err != nil {
+				return nil, err
+			}
+			return resp.Book.Id, nil
+		}
+		if _, err := s.UpdateBook(ctx, &pb.UpdateBookRequest{Book: book}); err != nil {
+			return nil, err
+		}
+		return book.Id, nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	result.BookId = bookID.(string)
+	if existing == nil {
+		result.Status = importCreated
+		return result
+	}
+	result.Status = importUpdated
+	result.ExternalId = book.ExternalId
+	result.Isbn_13 = book.Isbn_13
+	return result
+}
+
+// findImportedBook returns the book with the external ID or, failing that,
+// the ISBN, or nil if there is none.
+func (s *BookService) findImportedBook(ctx context.Context, externalID, isbn string) (*models.Title, error) {
+	filters := []bson.M{}
+	if externalID != "" {
+		filters = append(filters, bson.M{"external_id": externalID})
+	}
+	if isbn != "" {
+		filters = append(filters, bson.M{"isbn": isbn})
+	}
+
+	for _, filter := range filters {
+		var book models.Title
+		err := s.db.Collection("books").FindOne(ctx, filter).Decode(&book)
+		if err == nil {
+			return &book, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.Internal, "failed to fetch book")
+		}
+	}
+	return nil, nil
+}
+
+// importItems returns the copies to create a book from row with.
+func importItems(row importRow) ([]*pb.Item, error) {
+	if row.Copies < 0 || row.Copies > maxImportCopies || len(row.Barcodes) > maxImportCopies {
+		return nil, status.Errorf(codes.InvalidArgument, "a row can add at most %d copies", maxImportCopies)
+	}
+
+	var items []*pb.Item
+	for _, barcode := range row.Barcodes {
+		items = append(items, &pb.Item{Barcode: barcode})
+	}
+	for i := len(items); i < row.Copies; i++ {
+		items = append(items, &pb.Item{})
+	}
+	return items, nil
+}
+
+// importStreamReader reads a file streamed in chunks, which recv returns
+// until the stream ends with io.EOF.
+type importStreamReader struct {
+	recv func() ([]byte, error)
+	buf  []byte
+}
+
+func (r *importStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		data, err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+type csvImportDecoder struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+// newCSVImportDecoder reads the header row, which names the columns.
+func newCSVImportDecoder(in io.Reader) (*csvImportDecoder, error) {
+	r := csv.NewReader(in)
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, status.Errorf(codes.InvalidArgument, "file is empty")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to read header: %v", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		// Spreadsheets often start the file with a byte order mark.
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[name] = i
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "header has no title column")
+	}
+	r.FieldsPerRecord = len(header)
+
+	return &csvImportDecoder{r: r, columns: columns}, nil
+}
+
+func (d *csvImportDecoder) next() (int, importRow, error) {
+	record, err := d.r.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return parseErr.StartLine, importRow{}, &rowError{msg: parseErr.Err.Error()}
+	}
+	if err != nil {
+		return 0, importRow{}, err
+	}
+	line, _ := d.r.FieldPos(0)
+
+	field := func(name string) string {
+		if i, ok := d.columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	list := func(name string) []string {
+		var values []string
+		for _, v := range strings.Split(field(name), ";") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+
+	row := importRow{
+		ExternalID:    field("external_id"),
+		Title:         field("title"),
+		Author:        field("author"),
+		ISBN:          field("isbn"),
+		Description:   field("description"),
+		PublishedDate: field("published_date"),
+		Category:      field("category"),
+		SubjectIDs:    list("subject_ids"),
+		Subjects:      list("subjects"),
+		Tags:          list("tags"),
+		Dewey:         field("dewey"),
+		LCC:           field("lcc"),
+		Barcodes:      list("barcodes"),
+	}
+	if copies := field("copies"); copies != "" {
+		if row.Copies, err = strconv.Atoi(copies); err != nil {
+			return line, importRow{}, &rowError{msg: "copies must be a whole number"}
+		}
+	}
+	return line, row, nil
+}
+
+type jsonlImportDecoder struct {
+	r    *bufio.Reader
+	line int
+}
+
+func newJSONLImportDecoder(in io.Reader) *jsonlImportDecoder {
+	return &jsonlImportDecoder{r: bufio.NewReader(in)}
+}
+
+func (d *jsonlImportDecoder) next() (int, importRow, error) {
+	for {
+		data, err := d.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(data) == 0) {
+			return d.line, importRow{}, err
+		}
+		d.line++
+
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+
+		var row importRow
+		if err := json.Unmarshal(data, &row); err != nil {
+			return d.line, importRow{}, &rowError{msg: fmt.Sprintf("invalid JSON: %v", err)}
+		}
+		return d.line, row, nil
+	}
+}
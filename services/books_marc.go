@@ -0,0 +1,195 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+
+	"gc-buku/marc"
+	"gc-buku/models"
+	pb "gc-buku/proto"
+	"gc-buku/utils"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// exportChunkSize is how much of an exported file each streamed message
+// carries.
+const exportChunkSize = 64 * 1024
+
+// ImportMARC imports a file of MARC records the way ImportBooks imports
+// rows. Records are matched by their control number (001) as external ID,
+// then by ISBN. Authors and subjects are credited and filed by name, and
+// created as needed.
+func (s *BookService) ImportMARC(stream pb.BookService_ImportMARCServer) error {
+	ctx := stream.Context()
+
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Errorf(codes.InvalidArgument, "no file given")
+	}
+	if err != nil {
+		return err
+	}
+
+	in := &importStreamReader{buf: first.Data, recv: func() ([]byte, error) {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return req.Data, nil
+	}}
+	decoder := &marcImportDecoder{}
+	switch first.Format {
+	case "marc21":
+		decoder.read = marc.NewReader(in).Read
+	case "marcxml":
+		decoder.read = marc.NewXMLReader(in).Read
+	default:
+		return status.Errorf(codes.InvalidArgument, "format must be marc21 or marcxml")
+	}
+
+	resp, err := s.importRows(ctx, decoder, first.SkipExisting)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+// ExportMARC streams every book as a MARC record, in chunks of the file,
+// reading the catalog as ExportBooks does.
+func (s *BookService) ExportMARC(req *pb.ExportMARCRequest, stream pb.BookService_ExportMARCServer) error {
+	ctx := stream.Context()
+
+	out := &exportStreamWriter{send: func(data []byte) error {
+		return stream.Send(&pb.ExportMARCResponse{Data: data})
+	}}
+	var write func(*marc.Record) error
+	end := func() error { return nil }
+	switch req.Format {
+	case "marc21":
+		write = marc.NewWriter(out).Write
+	case "marcxml":
+		w := marc.NewXMLWriter(out)
+		write, end = w.Write, w.Close
+	default:
+		return status.Errorf(codes.InvalidArgument, "format must be marc21 or marcxml")
+	}
+
+	err := s.eachExportedBook(ctx, func(book models.Title, subjects []string) error {
+		err := write(marcBook(book, subjects).Record())
+		if errors.Is(err, marc.ErrTooLong) {
+			log.Printf("Leaving book %s out of MARC export: %v", book.ID.Hex(), err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := end(); err != nil {
+		return err
+	}
+	return out.flush()
+}
+
+// marcImportDecoder reads the records of a MARC file as import rows,
+// numbering them from 1.
+type marcImportDecoder struct {
+	read func() (*marc.Record, error)
+	n    int
+}
+
+func (d *marcImportDecoder) next() (int, importRow, error) {
+	rec, err := d.read()
+	if err == io.EOF {
+		return d.n, importRow{}, io.EOF
+	}
+	d.n++
+	if errors.Is(err, marc.ErrInvalidRecord) {
+		return d.n, importRow{}, &rowError{msg: err.Error()}
+	}
+	if err != nil {
+		return d.n, importRow{}, err
+	}
+	return d.n, marcImportRow(marc.BookFromRecord(rec)), nil
+}
+
+func marcImportRow(book marc.Book) importRow {
+	row := importRow{
+		ExternalID:    book.ControlNumber,
+		Title:         book.Title,
+		PublishedDate: book.Year(),
+		Subjects:      book.Subjects,
+	}
+	for _, c := range book.Contributors {
+		row.Contributors = append(row.Contributors, importContributor{Name: c.Name, Role: c.Role})
+	}
+	// Records often carry an ISBN per format; use the first valid one.
+	for _, isbn := range book.ISBNs {
+		if _, err := utils.NormalizeISBN(isbn); err == nil {
+			row.ISBN = isbn
+			break
+		}
+	}
+	if row.ISBN == "" && len(book.ISBNs) > 0 {
+		row.ISBN = book.ISBNs[0]
+	}
+	return row
+}
+
+// marcBook describes book for a MARC record. Books without an external ID
+// use their own ID as control number.
+func marcBook(book models.Title, subjects []string) marc.Book {
+	b := marc.Book{
+		ControlNumber: book.ExternalID,
+		Title:         book.Title,
+		Subjects:      subjects,
+	}
+	if b.ControlNumber == "" {
+		b.ControlNumber = book.ID.Hex()
+	}
+	if book.ISBN != "" {
+		b.ISBNs = []string{book.ISBN}
+	}
+	for _, c := range book.Contributors {
+		b.Contributors = append(b.Contributors, marc.Contributor{Name: c.Name, Role: c.Role})
+	}
+	if len(b.Contributors) == 0 && book.Author != "" {
+		b.Contributors = []marc.Contributor{{Name: book.Author, Role: models.ContributorRoleAuthor}}
+	}
+	if !book.PublishedDate.IsZero() {
+		b.Date = strconv.Itoa(book.PublishedDate.Year())
+	}
+	return b
+}
+
+// exportStreamWriter buffers an exported file and sends it in chunks of
+// about exportChunkSize. flush sends what is left.
+type exportStreamWriter struct {
+	send func([]byte) error
+	buf  bytes.Buffer
+}
+
+func (w *exportStreamWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	if w.buf.Len() >= exportChunkSize {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *exportStreamWriter) flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	err := w.send(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
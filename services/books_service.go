@@ -2,18 +2,69 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"gc-buku/models"
 	pb "gc-buku/proto"
+	"gc-buku/utils"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	defaultBookPageSize = 20
+	maxBookPageSize     = 100
+
+	defaultSearchLimit = 10
+	maxSearchLimit     = 50
+
+	// maxFacetValues is how many of the most common values each facet lists.
+	maxFacetValues = 20
+	// maxSearchFacetMatches caps how many matches search facets are counted
+	// over.
+	maxSearchFacetMatches = 1000
+
+	// Bonuses added to the text score when the last search term is a prefix
+	// of a word in the title or author, so type-ahead queries rank sensibly.
+	titlePrefixBonus  = 1.0
+	authorPrefixBonus = 0.5
+)
+
+// bookSortFields maps the sort_by values accepted by ListBooks to document fields.
+var bookSortFields = map[string]string{
+	"":               "_id",
+	"id":             "_id",
+	"title":          "title",
+	"author":         "author",
+	"published_date": "published_date",
+}
+
+// bookPageToken is the decoded form of the opaque ListBooks page token. It
+// records the sort key and _id of the last book returned so the next page can
+// resume after it.
+type bookPageToken struct {
+	SortBy     string             `bson:"s"`
+	Descending bool               `bson:"d"`
+	Value      interface{}        `bson:"v"`
+	ID         primitive.ObjectID `bson:"i"`
+}
+
+// scoredBook is a book decoded together with its $text relevance score.
+type scoredBook struct {
+	Book  models.Title `bson:",inline"`
+	Score float64      `bson:"score"`
+}
+
 type BookService struct {
 	db *mongo.Database
 }
@@ -22,33 +73,86 @@ func NewBookService(db *mongo.Database) *BookService {
 	return &BookService{db: db}
 }
 
+// CreateBook adds a title together with its copies.
 func (s *BookService) CreateBook(ctx context.Context, req *pb.CreateBookRequest) (*pb.CreateBookResponse, error) {
-	book := models.Book{
-		Title:         req.Book.Title,
-		Author:        req.Book.Author,
-		PublishedDate: time.Now(),
-		Status:        "available",
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
 	}
+	defer session.EndSession(ctx)
 
-	result, err := s.db.Collection("books").InsertOne(ctx, book)
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return s.createBook(ctx, req)
+	})
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create book: %v", err)
+		return nil, err
+	}
+	return result.(*pb.CreateBookResponse), nil
+}
+
+// createBook is CreateBook within the caller's transaction.
+func (s *BookService) createBook(ctx context.Context, req *pb.CreateBookRequest) (*pb.CreateBookResponse, error) {
+	book := models.Title{
+		ID:          primitive.NewObjectID(),
+		Title:       req.Book.Title,
+		ExternalID:  strings.TrimSpace(req.Book.ExternalId),
+		Description: req.Book.Description,
+		Category:    req.Book.Category,
 	}
 
-	objectID := result.InsertedID.(primitive.ObjectID)
-	return &pb.CreateBookResponse{
-		Book: &pb.Book{
-			Id:            objectID.Hex(),
-			Title:         book.Title,
-			Author:        book.Author,
-			PublishedDate: book.PublishedDate.Format(time.RFC3339),
-			Status:        book.Status,
-		},
-	}, nil
+	requested := req.Items
+	if len(requested) == 0 {
+		requested = []*pb.Item{{}}
+	}
+	var violations fieldViolations
+	book.ISBN = bookISBN(&violations, "book", req.Book)
+	book.Tags, book.Dewey, book.LCC = bookClassification(&violations, "book", req.Book)
+	validateExternalID(&violations, "book.external_id", book.ExternalID)
+	book.PublishedDate = parsePublishedDate(&violations, "book.published_date", req.Book.PublishedDate)
+	if book.PublishedDate.IsZero() {
+		book.PublishedDate = time.Now()
+	}
+	items := make([]interface{}, 0, len(requested))
+	for i, r := range requested {
+		items = append(items, newItem(&violations, fmt.Sprintf("items[%d]", i), book.ID, r))
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	contributors, err := resolveContributors(ctx, s.db, "book", req.Book)
+	if err != nil {
+		return nil, err
+	}
+	book.Contributors = contributors
+	book.Author = contributorsDisplay(contributors)
+	if book.SubjectIDs, err = resolveSubjects(ctx, s.db, "book", req.Book.SubjectIds); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.db.Collection("books").InsertOne(ctx, book); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, duplicateBookError(err, book.ISBN, book.ExternalID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to create book: %v", err)
+	}
+	if _, err := s.db.Collection("items").InsertMany(ctx, items); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, status.Errorf(codes.AlreadyExists, "barcode is already in use")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to create items")
+	}
+	if err := refreshTitleAvailability(ctx, s.db, book.ID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update book availability")
+	}
+	if err := s.db.Collection("books").FindOne(ctx, bson.M{"_id": book.ID}).Decode(&book); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch book")
+	}
+	return &pb.CreateBookResponse{Book: bookToProto(book)}, nil
 }
 
 func (s *BookService) GetBook(ctx context.Context, req *pb.GetBookRequest) (*pb.GetBookResponse, error) {
-	var book models.Book
+	var book models.Title
 	objectID, err := primitive.ObjectIDFromHex(req.Id)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
@@ -59,16 +163,267 @@ func (s *BookService) GetBook(ctx context.Context, req *pb.GetBookRequest) (*pb.
 		return nil, status.Errorf(codes.NotFound, "book not found")
 	}
 
-	return &pb.GetBookResponse{
-		Book: &pb.Book{
-			Id:            book.ID.Hex(),
-			Title:         book.Title,
-			Author:        book.Author,
-			PublishedDate: book.PublishedDate.Format(time.RFC3339),
-			Status:        book.Status,
-			UserId:        book.UserID.Hex(),
+	return &pb.GetBookResponse{Book: bookToProto(book)}, nil
+}
+
+// GetBookByISBN looks a book up by its ISBN-10 or ISBN-13.
+func (s *BookService) GetBookByISBN(ctx context.Context, req *pb.GetBookByISBNRequest) (*pb.GetBookByISBNResponse, error) {
+	isbn, err := utils.NormalizeISBN(req.Isbn)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid ISBN: %v", err)
+	}
+
+	var book models.Title
+	err = s.db.Collection("books").FindOne(ctx, bson.M{"isbn": isbn}).Decode(&book)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.NotFound, "no book with ISBN %s", isbn)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to fetch book")
+	}
+
+	return &pb.GetBookByISBNResponse{Book: bookToProto(book)}, nil
+}
+
+func (s *BookService) ListBooks(ctx context.Context, req *pb.ListBooksRequest) (*pb.ListBooksResponse, error) {
+	sortField, ok := bookSortFields[req.SortBy]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sort_by %q", req.SortBy)
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultBookPageSize
+	}
+	if pageSize > maxBookPageSize {
+		pageSize = maxBookPageSize
+	}
+
+	filter := bson.M{}
+	if req.Status != "" {
+		filter["status"] = req.Status
+	}
+	if req.Author != "" {
+		filter["author"] = req.Author
+	}
+	if req.AuthorId != "" {
+		authorID, err := primitive.ObjectIDFromHex(req.AuthorId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid author ID")
+		}
+		filter["contributors.author_id"] = authorID
+	}
+	if req.SubjectId != "" {
+		subjectID, err := primitive.ObjectIDFromHex(req.SubjectId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid subject ID")
+		}
+		// Books filed under a narrower subject belong to the broader one too.
+		subjects, err := subjectTree(ctx, s.db, subjectID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch subjects")
+		}
+		filter["subject_ids"] = bson.M{"$in": subjects}
+	}
+	if req.Tag != "" {
+		filter["tags"] = strings.ToLower(strings.TrimSpace(req.Tag))
+	}
+	if req.Category != "" {
+		filter["category"] = req.Category
+	}
+
+	published := bson.M{}
+	if req.PublishedAfter != "" {
+		after, err := time.Parse(time.RFC3339, req.PublishedAfter)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid published_after")
+		}
+		published["$gte"] = after
+	}
+	if req.PublishedBefore != "" {
+		before, err := time.Parse(time.RFC3339, req.PublishedBefore)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid published_before")
+		}
+		published["$lt"] = before
+	}
+	if len(published) > 0 {
+		filter["published_date"] = published
+	}
+
+	resp := &pb.ListBooksResponse{}
+	// Facets count every matching book, not just this page.
+	if req.IncludeFacets {
+		facets, err := bookFacets(ctx, s.db, filter)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to count facets")
+		}
+		resp.Facets = facets
+	}
+
+	op, dir := "$gt", 1
+	if req.Descending {
+		op, dir = "$lt", -1
+	}
+
+	if req.PageToken != "" {
+		token, err := decodeBookPageToken(req.PageToken)
+		if err != nil || token.SortBy != sortField || token.Descending != req.Descending {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+		}
+		if sortField == "_id" {
+			filter["_id"] = bson.M{op: token.ID}
+		} else {
+			filter["$or"] = bson.A{
+				bson.M{sortField: bson.M{op: token.Value}},
+				bson.M{sortField: token.Value, "_id": bson.M{op: token.ID}},
+			}
+		}
+	}
+
+	order := bson.D{{Key: "_id", Value: dir}}
+	if sortField != "_id" {
+		order = bson.D{{Key: sortField, Value: dir}, {Key: "_id", Value: dir}}
+	}
+
+	// Fetch one extra document to find out whether another page exists.
+	opts := options.Find().SetSort(order).SetLimit(int64(pageSize + 1))
+	cursor, err := s.db.Collection("books").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list books")
+	}
+	defer cursor.Close(ctx)
+
+	var books []models.Title
+	if err := cursor.All(ctx, &books); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode books")
+	}
+
+	if len(books) > pageSize {
+		books = books[:pageSize]
+		last := books[len(books)-1]
+		token := bookPageToken{
+			SortBy:     sortField,
+			Descending: req.Descending,
+			ID:         last.ID,
+		}
+		switch sortField {
+		case "title":
+			token.Value = last.Title
+		case "author":
+			token.Value = last.Author
+		case "published_date":
+			token.Value = last.PublishedDate
+		}
+		resp.NextPageToken, err = encodeBookPageToken(token)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode page token")
+		}
+	}
+
+	for _, book := range books {
+		resp.Books = append(resp.Books, bookToProto(book))
+	}
+
+	return resp, nil
+}
+
+func (s *BookService) SearchBooks(ctx context.Context, req *pb.SearchBooksRequest) (*pb.SearchBooksResponse, error) {
+	terms := strings.Fields(req.Query)
+	if len(terms) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "query is required")
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	results := make(map[primitive.ObjectID]*scoredBook)
+
+	// Whole-word matches ranked by the text index.
+	textOpts := options.Find().
+		SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetSort(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetLimit(int64(limit))
+	cursor, err := s.db.Collection("books").Find(ctx, bson.M{"$text": bson.M{"$search": req.Query}}, textOpts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to search books")
+	}
+	var matches []scoredBook
+	if err := cursor.All(ctx, &matches); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode books")
+	}
+	for i := range matches {
+		results[matches[i].Book.ID] = &matches[i]
+	}
+
+	// Prefix matches on the last term, which may still be being typed.
+	prefix := terms[len(terms)-1]
+	pattern := primitive.Regex{Pattern: `\b` + regexp.QuoteMeta(prefix), Options: "i"}
+	cursor, err = s.db.Collection("books").Find(ctx, bson.M{
+		"$or": bson.A{
+			bson.M{"title": pattern},
+			bson.M{"author": pattern},
 		},
-	}, nil
+	}, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to search books")
+	}
+	var prefixMatches []models.Title
+	if err := cursor.All(ctx, &prefixMatches); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode books")
+	}
+
+	prefixRe := regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(prefix))
+	for _, book := range prefixMatches {
+		result, ok := results[book.ID]
+		if !ok {
+			result = &scoredBook{Book: book}
+			results[book.ID] = result
+		}
+		if prefixRe.MatchString(book.Title) {
+			result.Score += titlePrefixBonus
+		}
+		if prefixRe.MatchString(book.Author) {
+			result.Score += authorPrefixBonus
+		}
+	}
+
+	ranked := make([]*scoredBook, 0, len(results))
+	for _, result := range results {
+		ranked = append(ranked, result)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].Book.Title < ranked[j].Book.Title
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	resp := &pb.SearchBooksResponse{}
+	for _, result := range ranked {
+		resp.Results = append(resp.Results, &pb.SearchResult{
+			Book:  bookToProto(result.Book),
+			Score: result.Score,
+		})
+	}
+
+	if req.IncludeFacets {
+		facets, err := s.searchFacets(ctx, req.Query, pattern)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to count facets")
+		}
+		resp.Facets = facets
+	}
+
+	return resp, nil
 }
 
 func (s *BookService) UpdateBook(ctx context.Context, req *pb.UpdateBookRequest) (*pb.UpdateBookResponse, error) {
@@ -77,33 +432,377 @@ func (s *BookService) UpdateBook(ctx context.Context, req *pb.UpdateBookRequest)
 		return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
 	}
 
-	update := bson.M{
-		"$set": bson.M{
-			"title":          req.Book.Title,
-			"author":         req.Book.Author,
-			"published_date": req.Book.PublishedDate,
-			"status":         req.Book.Status,
-		},
+	var violations fieldViolations
+	isbn := bookISBN(&violations, "book", req.Book)
+	tags, dewey, lcc := bookClassification(&violations, "book", req.Book)
+	externalID := strings.TrimSpace(req.Book.ExternalId)
+	validateExternalID(&violations, "book.external_id", externalID)
+	publishedDate := parsePublishedDate(&violations, "book.published_date", req.Book.PublishedDate)
+	if err := violations.err(); err != nil {
+		return nil, err
 	}
 
-	_, err = s.db.Collection("books").UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	contributors, err := s.updatedContributors(ctx, objectID, req.Book)
 	if err != nil {
+		return nil, err
+	}
+	subjectIDs, err := resolveSubjects(ctx, s.db, "book", req.Book.SubjectIds)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{
+		"title":          req.Book.Title,
+		"author":         contributorsDisplay(contributors),
+		"contributors":   contributors,
+		"published_date": publishedDate,
+		"category":       req.Book.Category,
+		"isbn":           isbn,
+		"external_id":    externalID,
+		"description":    req.Book.Description,
+		"subject_ids":    subjectIDs,
+		"tags":           tags,
+		"dewey":          dewey,
+		"lcc":            lcc,
+	}
+	unset := bson.M{}
+	// Books without an ISBN must not store an empty one, which the unique
+	// index would treat as a duplicate.
+	if isbn == "" {
+		delete(set, "isbn")
+		unset["isbn"] = ""
+	}
+	if externalID == "" {
+		delete(set, "external_id")
+		unset["external_id"] = ""
+	}
+	if publishedDate.IsZero() {
+		delete(set, "published_date")
+	}
+	if len(contributors) == 0 {
+		delete(set, "contributors")
+		unset["contributors"] = ""
+	}
+	if len(subjectIDs) == 0 {
+		delete(set, "subject_ids")
+		unset["subject_ids"] = ""
+	}
+	if len(tags) == 0 {
+		delete(set, "tags")
+		unset["tags"] = ""
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	var book models.Title
+	err = s.db.Collection("books").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": objectID},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&book)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, duplicateBookError(err, isbn, externalID)
+		}
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.NotFound, "book not found")
+		}
 		return nil, status.Errorf(codes.Internal, "failed to update book")
 	}
 
-	return &pb.UpdateBookResponse{Book: req.Book}, nil
+	return &pb.UpdateBookResponse{Book: bookToProto(book)}, nil
 }
 
+// updatedContributors resolves the contributors of a book being updated. A
+// book sent back as it was fetched has its contributors' display string as
+// author and no contributors; that keeps the contributors it has rather
+// than being read as the name of one author.
+func (s *BookService) updatedContributors(ctx context.Context, id primitive.ObjectID, book *pb.Book) ([]models.Contributor, error) {
+	author := strings.TrimSpace(book.Author)
+	if len(book.Contributors) == 0 && author != "" {
+		var existing models.Title
+		opts := options.FindOne().SetProjection(bson.M{"author": 1, "contributors": 1})
+		err := s.db.Collection("books").FindOne(ctx, bson.M{"_id": id}, opts).Decode(&existing)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.Internal, "failed to fetch book")
+		}
+		if len(existing.Contributors) > 0 && author == existing.Author {
+			return existing.Contributors, nil
+		}
+	}
+	return resolveContributors(ctx, s.db, "book", book)
+}
+
+// DeleteBook removes a book and its copies. Books with copies on loan or on
+// the hold shelf cannot be deleted; waiting holds on them are cancelled.
 func (s *BookService) DeleteBook(ctx context.Context, req *pb.DeleteBookRequest) (*pb.DeleteBookResponse, error) {
 	objectID, err := primitive.ObjectIDFromHex(req.Id)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
 	}
 
-	_, err = s.db.Collection("books").DeleteOne(ctx, bson.M{"_id": objectID})
+	session, err := s.db.Client().StartSession()
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to delete book")
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		circulating, err := s.db.Collection("items").CountDocuments(ctx, bson.M{
+			"title_id": objectID,
+			"status":   bson.M{"$nin": shelvedItemStatuses},
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check items")
+		}
+		if circulating > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "%d copies are on loan or on the hold shelf", circulating)
+		}
+
+		_, err = s.db.Collection("holds").UpdateMany(
+			ctx,
+			bson.M{"book_id": objectID, "status": models.HoldStatusWaiting},
+			bson.M{"$set": bson.M{"status": models.HoldStatusCancelled}},
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to cancel holds")
+		}
+		if _, err := s.db.Collection("items").DeleteMany(ctx, bson.M{"title_id": objectID}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete items")
+		}
+		if _, err := s.db.Collection("books").DeleteOne(ctx, bson.M{"_id": objectID}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete book")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &pb.DeleteBookResponse{Id: req.Id}, nil
 }
+
+// searchFacets counts facets over the books matching a search, beyond the
+// ones returned. Matches past maxSearchFacetMatches are not counted.
+func (s *BookService) searchFacets(ctx context.Context, query string, prefix primitive.Regex) ([]*pb.Facet, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(maxSearchFacetMatches)
+	filters := []bson.M{
+		{"$text": bson.M{"$search": query}},
+		{"$or": bson.A{bson.M{"title": prefix}, bson.M{"author": prefix}}},
+	}
+
+	ids := bson.A{}
+	seen := make(map[primitive.ObjectID]bool)
+	for _, filter := range filters {
+		cursor, err := s.db.Collection("books").Find(ctx, filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		var matches []models.Title
+		if err := cursor.All(ctx, &matches); err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if !seen[match.ID] && len(ids) < maxSearchFacetMatches {
+				seen[match.ID] = true
+				ids = append(ids, match.ID)
+			}
+		}
+	}
+
+	return bookFacets(ctx, s.db, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+// bookFacets counts the books matching filter by subject, tag, category and
+// status, listing the most common values of each. Subjects are labelled with
+// their names.
+func bookFacets(ctx context.Context, db *mongo.Database, filter bson.M) ([]*pb.Facet, error) {
+	countBy := func(field string, unwind bool) bson.A {
+		stages := bson.A{}
+		if unwind {
+			stages = append(stages, bson.M{"$unwind": "$" + field})
+		}
+		return append(stages,
+			bson.M{"$match": bson.M{field: bson.M{"$nin": bson.A{"", nil}}}},
+			bson.M{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$limit": maxFacetValues},
+		)
+	}
+
+	fields := []struct {
+		name   string
+		field  string
+		unwind bool
+	}{
+		{"subject", "subject_ids", true},
+		{"tag", "tags", true},
+		{"category", "category", false},
+		{"status", "status", false},
+	}
+	facetStage := bson.M{}
+	for _, f := range fields {
+		facetStage[f.name] = countBy(f.field, f.unwind)
+	}
+
+	cursor, err := db.Collection("books").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$facet", Value: facetStage}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type facetCount struct {
+		Value interface{} `bson:"_id"`
+		Count int32       `bson:"count"`
+	}
+	var results []map[string][]facetCount
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	counts := results[0]
+
+	// Look up the names of the subjects counted.
+	subjectIDs := bson.A{}
+	for _, c := range counts["subject"] {
+		subjectIDs = append(subjectIDs, c.Value)
+	}
+	names := make(map[primitive.ObjectID]string)
+	if len(subjectIDs) > 0 {
+		cursor, err := db.Collection("subjects").Find(ctx, bson.M{"_id": bson.M{"$in": subjectIDs}})
+		if err != nil {
+			return nil, err
+		}
+		var subjects []models.Subject
+		if err := cursor.All(ctx, &subjects); err != nil {
+			return nil, err
+		}
+		for _, subject := range subjects {
+			names[subject.ID] = subject.Name
+		}
+	}
+
+	facets := make([]*pb.Facet, 0, len(fields))
+	for _, f := range fields {
+		facet := &pb.Facet{Field: f.name}
+		for _, c := range counts[f.name] {
+			value := &pb.FacetValue{Count: c.Count}
+			switch v := c.Value.(type) {
+			case primitive.ObjectID:
+				value.Value = v.Hex()
+				value.Label = names[v]
+			case string:
+				value.Value = v
+				value.Label = v
+			default:
+				continue
+			}
+			facet.Values = append(facet.Values, value)
+		}
+		facets = append(facets, facet)
+	}
+	return facets, nil
+}
+
+func bookToProto(book models.Title) *pb.Book {
+	return &pb.Book{
+		Id:              book.ID.Hex(),
+		Title:           book.Title,
+		Author:          book.Author,
+		Contributors:    contributorsToProto(book.Contributors),
+		PublishedDate:   book.PublishedDate.Format(time.RFC3339),
+		Status:          book.Status,
+		Category:        book.Category,
+		Isbn_13:         book.ISBN,
+		Isbn_10:         utils.ISBN10(book.ISBN),
+		ExternalId:      book.ExternalID,
+		Description:     book.Description,
+		SubjectIds:      idsToHex(book.SubjectIDs),
+		Tags:            book.Tags,
+		Dewey:           book.Dewey,
+		Lcc:             book.LCC,
+		TotalCopies:     int32(book.TotalCopies),
+		AvailableCopies: int32(book.AvailableCopies),
+	}
+}
+
+// bookISBN validates the ISBNs given for book and returns its normalized
+// ISBN-13, or "" when it has none. If both forms are given they must agree.
+func bookISBN(v *fieldViolations, field string, book *pb.Book) string {
+	var isbn13, isbn10 string
+	var err error
+	if book.Isbn_13 != "" {
+		if isbn13, err = utils.NormalizeISBN(book.Isbn_13); err != nil {
+			v.add(field+".isbn_13", err.Error())
+		}
+	}
+	if book.Isbn_10 != "" {
+		if isbn10, err = utils.NormalizeISBN(book.Isbn_10); err != nil {
+			v.add(field+".isbn_10", err.Error())
+		}
+	}
+
+	if isbn13 != "" && isbn10 != "" && isbn13 != isbn10 {
+		v.add(field+".isbn_10", "ISBN-10 and ISBN-13 are of different books")
+	}
+	if isbn13 != "" {
+		return isbn13
+	}
+	return isbn10
+}
+
+// duplicateBookError reports which unique book field a duplicate key error
+// is about.
+func duplicateBookError(err error, isbn, externalID string) error {
+	if strings.Contains(err.Error(), "external_id") {
+		return status.Errorf(codes.AlreadyExists, "a book with external ID %q already exists", externalID)
+	}
+	return status.Errorf(codes.AlreadyExists, "a book with ISBN %s already exists", isbn)
+}
+
+// bookClassification validates and normalizes the tags and call numbers
+// given for book.
+func bookClassification(v *fieldViolations, field string, book *pb.Book) (tags []string, dewey, lcc string) {
+	tags = normalizeTags(v, field+".tags", book.Tags)
+	dewey = strings.ToUpper(strings.TrimSpace(book.Dewey))
+	validateDewey(v, field+".dewey", dewey)
+	lcc = strings.ToUpper(strings.TrimSpace(book.Lcc))
+	validateLCC(v, field+".lcc", lcc)
+	return tags, dewey, lcc
+}
+
+func idsToHex(ids []primitive.ObjectID) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+	hex := make([]string, 0, len(ids))
+	for _, id := range ids {
+		hex = append(hex, id.Hex())
+	}
+	return hex
+}
+
+func encodeBookPageToken(token bookPageToken) (string, error) {
+	data, err := bson.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeBookPageToken(s string) (bookPageToken, error) {
+	var token bookPageToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return token, err
+	}
+	err = bson.Unmarshal(data, &token)
+	return token, err
+}
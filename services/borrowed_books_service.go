@@ -2,18 +2,33 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
 	"time"
 
 	"gc-buku/models"
 	pb "gc-buku/proto"
+	"gc-buku/utils"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	defaultLoanPageSize = 20
+	maxLoanPageSize     = 100
+)
+
+// loanPageToken is the decoded form of the opaque ListLoans page token: the
+// borrow date and _id of the last loan returned.
+type loanPageToken struct {
+	BorrowedDate time.Time          `bson:"t"`
+	ID           primitive.ObjectID `bson:"i"`
+}
+
 type BorrowService struct {
 	db *mongo.Database
 }
@@ -22,15 +37,25 @@ func NewBorrowService(db *mongo.Database) *BorrowService {
 	return &BorrowService{db: db}
 }
 
+// BorrowBook lends the copy with the given barcode, or any copy of the given
+// book that can be lent to the caller. A copy waiting on the hold shelf for
+// the caller is preferred over one that is available to everyone.
 func (s *BorrowService) BorrowBook(ctx context.Context, req *pb.BorrowBookRequest) (*pb.BorrowBookResponse, error) {
-	bookID, err := primitive.ObjectIDFromHex(req.BorrowedBook.BookId)
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
+	var bookID primitive.ObjectID
+	if req.BorrowedBook != nil && req.BorrowedBook.BookId != "" {
+		var err error
+		bookID, err = primitive.ObjectIDFromHex(req.BorrowedBook.BookId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
+		}
+	} else if req.Barcode == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "book ID or barcode is required")
 	}
 
-	userID, err := primitive.ObjectIDFromHex(req.BorrowedBook.UserId)
+	// Loans are always made to the authenticated caller
+	userID, err := callerID(ctx)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+		return nil, err
 	}
 
 	// Start session for transaction
@@ -42,25 +67,57 @@ func (s *BorrowService) BorrowBook(ctx context.Context, req *pb.BorrowBookReques
 
 	// Transaction
 	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
-		// Check if book is available
-		var book models.Book
-		err := s.db.Collection("books").FindOne(ctx, bson.M{
-			"_id":    bookID,
-			"status": "available",
-		}).Decode(&book)
-
+		item, err := s.lendableItem(ctx, bookID, req.Barcode, userID)
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
 				return nil, status.Errorf(codes.NotFound, "book not available")
 			}
+			return nil, status.Errorf(codes.Internal, "failed to fetch item")
+		}
+
+		var book models.Title
+		if err := s.db.Collection("books").FindOne(ctx, bson.M{"_id": item.TitleID}).Decode(&book); err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to fetch book")
 		}
 
+		var user models.User
+		err = s.db.Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.NotFound, "user not found")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to fetch user")
+		}
+
+		terms, err := resolveLoanTerms(ctx, s.db, book.Category, user)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resolve loan policy")
+		}
+
+		if err := checkBorrowingEligibility(ctx, s.db, user, terms); err != nil {
+			return nil, err
+		}
+
+		// Borrowing any copy of the book fulfils the caller's ready hold on it
+		var hold models.Hold
+		err = s.db.Collection("holds").FindOneAndUpdate(
+			ctx,
+			bson.M{"book_id": book.ID, "user_id": userID, "status": models.HoldStatusReady},
+			bson.M{"$set": bson.M{"status": models.HoldStatusFulfilled}},
+		).Decode(&hold)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.Internal, "failed to fulfil hold")
+		}
+
 		// Create borrow record
+		now := time.Now()
 		borrowedBook := models.BorrowedBook{
-			BookID:       bookID,
+			BookID:       book.ID,
+			ItemID:       item.ID,
 			UserID:       userID,
-			BorrowedDate: time.Now(),
+			BorrowedDate: now,
+			DueDate:      now.Add(terms.Period),
+			Status:       models.LoanStatusActive,
 		}
 
 		borrowResult, err := s.db.Collection("borrowed_books").InsertOne(ctx, borrowedBook)
@@ -68,34 +125,39 @@ func (s *BorrowService) BorrowBook(ctx context.Context, req *pb.BorrowBookReques
 			return nil, status.Errorf(codes.Internal, "failed to create borrow record")
 		}
 
-		// Update book status
-		_, err = s.db.Collection("books").UpdateOne(
+		// Update item status
+		_, err = s.db.Collection("items").UpdateOne(
 			ctx,
-			bson.M{"_id": bookID},
+			bson.M{"_id": item.ID},
 			bson.M{"$set": bson.M{
-				"status":  "borrowed",
+				"status":  models.ItemStatusBorrowed,
 				"user_id": userID,
 			}},
 		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update item status")
+		}
+
+		// The copy that was kept for the caller is no longer needed
+		if !hold.ItemID.IsZero() && hold.ItemID != item.ID {
+			err = advanceHoldQueue(ctx, s.db, book.ID, hold.ItemID)
+		} else {
+			err = refreshTitleAvailability(ctx, s.db, book.ID)
+		}
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to update book status")
 		}
 
-		return borrowResult.InsertedID, nil
+		borrowedBook.ID = borrowResult.InsertedID.(primitive.ObjectID)
+		return &borrowedBook, nil
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	objectID := result.(primitive.ObjectID)
 	return &pb.BorrowBookResponse{
-		BorrowedBook: &pb.BorrowedBook{
-			Id:           objectID.Hex(),
-			BookId:       bookID.Hex(),
-			UserId:       userID.Hex(),
-			BorrowedDate: time.Now().Format(time.RFC3339),
-		},
+		BorrowedBook: borrowedBookToProto(*result.(*models.BorrowedBook)),
 	}, nil
 }
 
@@ -111,6 +173,11 @@ func (s *BorrowService) ReturnBook(ctx context.Context, req *pb.ReturnBookReques
 	}
 	defer session.EndSession(ctx)
 
+	filter, err := s.openLoanFilter(ctx, objectID)
+	if err != nil {
+		return nil, err
+	}
+
 	var borrowedBook models.BorrowedBook
 	returnTime := time.Now()
 
@@ -118,11 +185,12 @@ func (s *BorrowService) ReturnBook(ctx context.Context, req *pb.ReturnBookReques
 		// Find and update borrowed book
 		err := s.db.Collection("borrowed_books").FindOneAndUpdate(
 			ctx,
-			bson.M{
-				"_id":         objectID,
-				"return_date": nil,
-			},
-			bson.M{"$set": bson.M{"return_date": returnTime}},
+			filter,
+			bson.M{"$set": bson.M{
+				"return_date": returnTime,
+				"status":      models.LoanStatusReturned,
+			}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
 		).Decode(&borrowedBook)
 
 		if err != nil {
@@ -132,19 +200,134 @@ func (s *BorrowService) ReturnBook(ctx context.Context, req *pb.ReturnBookReques
 			return nil, status.Errorf(codes.Internal, "failed to update borrow record")
 		}
 
-		// Update book status
-		_, err = s.db.Collection("books").UpdateOne(
+		// Charge for any days past the due date
+		if err := accrueLoanFine(ctx, s.db, borrowedBook, returnTime); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record overdue fine")
+		}
+
+		// Hand the copy to the next hold in the queue, or make it available
+		if err := advanceHoldQueue(ctx, s.db, borrowedBook.BookID, borrowedBook.ItemID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update book status")
+		}
+
+		return &borrowedBook, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ReturnBookResponse{
+		BorrowedBook: borrowedBookToProto(*result.(*models.BorrowedBook)),
+	}, nil
+}
+
+func (s *BorrowService) RenewLoan(ctx context.Context, req *pb.RenewLoanRequest) (*pb.RenewLoanResponse, error) {
+	objectID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid borrow ID")
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	filter, err := s.openLoanFilter(ctx, objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		var borrowedBook models.BorrowedBook
+		err := s.db.Collection("borrowed_books").FindOne(ctx, filter).Decode(&borrowedBook)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.NotFound, "borrow record not found or already returned")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to fetch borrow record")
+		}
+
+		var book models.Title
+		if err := s.db.Collection("books").FindOne(ctx, bson.M{"_id": borrowedBook.BookID}).Decode(&book); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch book")
+		}
+
+		var user models.User
+		if err := s.db.Collection("users").FindOne(ctx, bson.M{"_id": borrowedBook.UserID}).Decode(&user); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch user")
+		}
+
+		terms, err := resolveLoanTerms(ctx, s.db, book.Category, user)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resolve loan policy")
+		}
+
+		now := time.Now()
+		dueDate := loanDueDate(borrowedBook, terms)
+		if borrowedBook.RenewalCount >= terms.MaxRenewals {
+			return nil, status.Errorf(codes.FailedPrecondition, "renewal limit reached")
+		}
+		if now.After(dueDate.Add(terms.RenewalGrace)) {
+			return nil, status.Errorf(codes.FailedPrecondition, "loan is overdue")
+		}
+
+		holds, err := s.db.Collection("holds").CountDocuments(ctx, bson.M{
+			"book_id": borrowedBook.BookID,
+			"status":  models.HoldStatusWaiting,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check holds")
+		}
+		if holds > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "book has a waiting hold")
+		}
+
+		// Extend from the later of now and the current due date so early
+		// renewals never shorten a loan.
+		from := dueDate
+		if now.After(from) {
+			from = now
+		}
+		renewal := models.LoanRenewal{
+			RenewedAt:       now,
+			PreviousDueDate: dueDate,
+			DueDate:         from.Add(terms.Period),
+		}
+
+		err = s.db.Collection("borrowed_books").FindOneAndUpdate(
 			ctx,
-			bson.M{"_id": borrowedBook.BookID},
+			bson.M{
+				"_id":           objectID,
+				"return_date":   nil,
+				"renewal_count": borrowedBook.RenewalCount,
+			},
 			bson.M{
 				"$set": bson.M{
-					"status":  "available",
-					"user_id": nil,
+					"due_date": renewal.DueDate,
+					"status":   models.LoanStatusActive,
 				},
+				"$inc":  bson.M{"renewal_count": 1},
+				"$push": bson.M{"renewals": renewal},
 			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&borrowedBook)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.Aborted, "borrow record changed, try again")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to renew loan")
+		}
+
+		// A loan renewed within its grace period is no longer overdue
+		_, err = s.db.Collection("items").UpdateOne(
+			ctx,
+			bson.M{"_id": borrowedBook.ItemID, "status": models.ItemStatusOverdue},
+			bson.M{"$set": bson.M{"status": models.ItemStatusBorrowed}},
 		)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to update book status")
+			return nil, status.Errorf(codes.Internal, "failed to update item status")
 		}
 
 		return &borrowedBook, nil
@@ -154,14 +337,239 @@ func (s *BorrowService) ReturnBook(ctx context.Context, req *pb.ReturnBookReques
 		return nil, err
 	}
 
-	borrowedBook = *result.(*models.BorrowedBook)
-	return &pb.ReturnBookResponse{
-		BorrowedBook: &pb.BorrowedBook{
-			Id:           borrowedBook.ID.Hex(),
-			BookId:       borrowedBook.BookID.Hex(),
-			UserId:       borrowedBook.UserID.Hex(),
-			BorrowedDate: borrowedBook.BorrowedDate.Format(time.RFC3339),
-			ReturnDate:   returnTime.Format(time.RFC3339),
-		},
+	return &pb.RenewLoanResponse{
+		BorrowedBook: borrowedBookToProto(*result.(*models.BorrowedBook)),
 	}, nil
 }
+
+// ListLoans lists loans matching the request, newest first. Patrons only see
+// their own loans; staff can list anyone's, or everyone's when no user is
+// given.
+func (s *BorrowService) ListLoans(ctx context.Context, req *pb.ListLoansRequest) (*pb.ListLoansResponse, error) {
+	caller, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultLoanPageSize
+	}
+	if pageSize > maxLoanPageSize {
+		pageSize = maxLoanPageSize
+	}
+
+	filter := bson.M{}
+	if req.UserId != "" {
+		userID, err := primitive.ObjectIDFromHex(req.UserId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+		}
+		filter["user_id"] = userID
+	}
+	if !callerCan(ctx, utils.PermLoansManage) {
+		if userID, ok := filter["user_id"]; ok && userID != caller {
+			return nil, status.Errorf(codes.PermissionDenied, "cannot view another user's loans")
+		}
+		filter["user_id"] = caller
+	}
+
+	if req.BookId != "" {
+		bookID, err := primitive.ObjectIDFromHex(req.BookId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
+		}
+		filter["book_id"] = bookID
+	}
+
+	switch req.Status {
+	case "":
+	case "open":
+		filter["return_date"] = nil
+	case "returned":
+		filter["return_date"] = bson.M{"$ne": nil}
+	case "overdue":
+		// Use the due date rather than the status so loans are overdue the
+		// moment they are due, not when the scheduler next runs.
+		filter["return_date"] = nil
+		filter["due_date"] = bson.M{"$lt": time.Now()}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid status %q", req.Status)
+	}
+
+	borrowed := bson.M{}
+	if req.BorrowedAfter != "" {
+		after, err := time.Parse(time.RFC3339, req.BorrowedAfter)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid borrowed_after")
+		}
+		borrowed["$gte"] = after
+	}
+	if req.BorrowedBefore != "" {
+		before, err := time.Parse(time.RFC3339, req.BorrowedBefore)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid borrowed_before")
+		}
+		borrowed["$lt"] = before
+	}
+	if len(borrowed) > 0 {
+		filter["borrowed_date"] = borrowed
+	}
+
+	if req.PageToken != "" {
+		token, err := decodeLoanPageToken(req.PageToken)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+		}
+		filter["$or"] = bson.A{
+			bson.M{"borrowed_date": bson.M{"$lt": token.BorrowedDate}},
+			bson.M{"borrowed_date": token.BorrowedDate, "_id": bson.M{"$lt": token.ID}},
+		}
+	}
+
+	// Fetch one extra document to find out whether another page exists.
+	opts := options.Find().
+		SetSort(bson.D{{Key: "borrowed_date", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(pageSize + 1))
+	cursor, err := s.db.Collection("borrowed_books").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list loans")
+	}
+
+	var loans []models.BorrowedBook
+	if err := cursor.All(ctx, &loans); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode loans")
+	}
+
+	resp := &pb.ListLoansResponse{}
+	if len(loans) > pageSize {
+		loans = loans[:pageSize]
+		last := loans[len(loans)-1]
+		resp.NextPageToken, err = encodeLoanPageToken(loanPageToken{BorrowedDate: last.BorrowedDate, ID: last.ID})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode page token")
+		}
+	}
+
+	titles, err := s.bookTitles(ctx, loans)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch books")
+	}
+	for _, loan := range loans {
+		pbLoan := borrowedBookToProto(loan)
+		pbLoan.BookTitle = titles[loan.BookID]
+		resp.Loans = append(resp.Loans, pbLoan)
+	}
+
+	return resp, nil
+}
+
+// bookTitles looks up the titles of the books lent out in loans.
+func (s *BorrowService) bookTitles(ctx context.Context, loans []models.BorrowedBook) (map[primitive.ObjectID]string, error) {
+	titles := make(map[primitive.ObjectID]string)
+	if len(loans) == 0 {
+		return titles, nil
+	}
+
+	ids := make(bson.A, 0, len(loans))
+	for _, loan := range loans {
+		ids = append(ids, loan.BookID)
+	}
+
+	cursor, err := s.db.Collection("books").Find(
+		ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"title": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var books []models.Title
+	if err := cursor.All(ctx, &books); err != nil {
+		return nil, err
+	}
+	for _, book := range books {
+		titles[book.ID] = book.Title
+	}
+	return titles, nil
+}
+
+// lendableItem finds a copy that can be lent to userID: the copy with the
+// given barcode, or otherwise a copy of bookID, preferring one kept on the
+// hold shelf for userID. If both are given the copy must be of bookID.
+func (s *BorrowService) lendableItem(ctx context.Context, bookID primitive.ObjectID, barcode string, userID primitive.ObjectID) (models.Item, error) {
+	candidates := []bson.M{
+		{"status": models.ItemStatusOnHoldShelf, "user_id": userID},
+		{"status": models.ItemStatusAvailable},
+	}
+
+	var item models.Item
+	for _, filter := range candidates {
+		if !bookID.IsZero() {
+			filter["title_id"] = bookID
+		}
+		if barcode != "" {
+			filter["barcode"] = barcode
+		}
+		err := s.db.Collection("items").FindOne(ctx, filter).Decode(&item)
+		if err != mongo.ErrNoDocuments {
+			return item, err
+		}
+	}
+	return item, mongo.ErrNoDocuments
+}
+
+// openLoanFilter matches an open loan by ID. Patrons can only act on their
+// own loans; staff can act on any.
+func (s *BorrowService) openLoanFilter(ctx context.Context, loanID primitive.ObjectID) (bson.M, error) {
+	filter := bson.M{
+		"_id":         loanID,
+		"return_date": nil,
+	}
+	if !callerCan(ctx, utils.PermLoansManage) {
+		userID, err := callerID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		filter["user_id"] = userID
+	}
+	return filter, nil
+}
+
+func borrowedBookToProto(borrowedBook models.BorrowedBook) *pb.BorrowedBook {
+	resp := &pb.BorrowedBook{
+		Id:           borrowedBook.ID.Hex(),
+		BookId:       borrowedBook.BookID.Hex(),
+		UserId:       borrowedBook.UserID.Hex(),
+		BorrowedDate: borrowedBook.BorrowedDate.Format(time.RFC3339),
+		DueDate:      borrowedBook.DueDate.Format(time.RFC3339),
+		Status:       borrowedBook.Status,
+		RenewalCount: int32(borrowedBook.RenewalCount),
+	}
+	if !borrowedBook.ItemID.IsZero() {
+		resp.ItemId = borrowedBook.ItemID.Hex()
+	}
+	if borrowedBook.ReturnDate != nil {
+		resp.ReturnDate = borrowedBook.ReturnDate.Format(time.RFC3339)
+	}
+	return resp
+}
+
+func encodeLoanPageToken(token loanPageToken) (string, error) {
+	data, err := bson.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeLoanPageToken(s string) (loanPageToken, error) {
+	var token loanPageToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return token, err
+	}
+	err = bson.Unmarshal(data, &token)
+	return token, err
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gc-buku/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons a user may not borrow, reported in the ErrorInfo detail of the
+// FailedPrecondition error.
+const (
+	IneligibleMembershipExpired = "MEMBERSHIP_EXPIRED"
+	IneligibleOverdueLoans      = "OVERDUE_LOANS"
+	IneligibleUnpaidFines       = "UNPAID_FINES"
+	IneligibleLoanLimit         = "LOAN_LIMIT_REACHED"
+)
+
+// errorDomain is the domain of ErrorInfo details returned by this server.
+const errorDomain = "gc-buku"
+
+// checkBorrowingEligibility returns a FailedPrecondition error if user may
+// not borrow another book under terms. It must run inside the borrowing
+// transaction so the counts cannot change before the loan is recorded.
+func checkBorrowingEligibility(ctx context.Context, db *mongo.Database, user models.User, terms loanTerms) error {
+	now := time.Now()
+	if user.MembershipExpiresAt != nil && user.MembershipExpiresAt.Before(now) {
+		return ineligible(IneligibleMembershipExpired, map[string]string{
+			"expired_at": user.MembershipExpiresAt.Format(time.RFC3339),
+		}, "membership expired on %s", user.MembershipExpiresAt.Format("2006-01-02"))
+	}
+
+	if terms.BlockOverdue {
+		overdue, err := db.Collection("borrowed_books").CountDocuments(ctx, bson.M{
+			"user_id":     user.ID,
+			"return_date": nil,
+			"due_date":    bson.M{"$lt": now},
+		})
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to check overdue loans")
+		}
+		if overdue > 0 {
+			return ineligible(IneligibleOverdueLoans, map[string]string{
+				"overdue_loans": strconv.FormatInt(overdue, 10),
+			}, "return %d overdue books before borrowing more", overdue)
+		}
+	}
+
+	balance, err := fineBalance(ctx, db, user.ID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to compute balance")
+	}
+	if balance > terms.MaxFineBalance {
+		return ineligible(IneligibleUnpaidFines, map[string]string{
+			"balance":     strconv.FormatInt(balance, 10),
+			"max_balance": strconv.FormatInt(terms.MaxFineBalance, 10),
+		}, "unpaid fines of %d exceed the limit of %d", balance, terms.MaxFineBalance)
+	}
+
+	open, err := db.Collection("borrowed_books").CountDocuments(ctx, bson.M{
+		"user_id":     user.ID,
+		"return_date": nil,
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to count loans")
+	}
+	if open >= int64(terms.MaxLoans) {
+		return ineligible(IneligibleLoanLimit, map[string]string{
+			"open_loans": strconv.FormatInt(open, 10),
+			"max_loans":  strconv.Itoa(terms.MaxLoans),
+		}, "loan limit of %d books reached", terms.MaxLoans)
+	}
+
+	return nil
+}
+
+// ineligible builds a FailedPrecondition error carrying reason and metadata
+// in an ErrorInfo detail.
+func ineligible(reason string, metadata map[string]string, format string, args ...interface{}) error {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(format, args...))
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   errorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,281 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+	"gc-buku/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type FineService struct {
+	db *mongo.Database
+}
+
+func NewFineService(db *mongo.Database) *FineService {
+	return &FineService{db: db}
+}
+
+func (s *FineService) ListFines(ctx context.Context, req *pb.ListFinesRequest) (*pb.ListFinesResponse, error) {
+	userID, err := primitive.ObjectIDFromHex(req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+	}
+
+	caller, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if userID != caller && !callerCan(ctx, utils.PermFinesManage) {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot view another user's fines")
+	}
+
+	cursor, err := s.db.Collection("fines").Find(ctx, bson.M{"user_id": userID}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list fines")
+	}
+
+	var entries []models.FineEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode fines")
+	}
+
+	resp := &pb.ListFinesResponse{}
+	for _, entry := range entries {
+		resp.Entries = append(resp.Entries, fineEntryToProto(entry))
+		resp.Balance += signedFineAmount(entry)
+	}
+
+	return resp, nil
+}
+
+func (s *FineService) PayFine(ctx context.Context, req *pb.PayFineRequest) (*pb.PayFineResponse, error) {
+	userID, err := primitive.ObjectIDFromHex(req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+	}
+
+	entry, balance, err := s.settle(ctx, userID, models.FineEntry{
+		UserID: userID,
+		Type:   models.FineEntryPayment,
+		Amount: req.Amount,
+		Note:   req.Note,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.PayFineResponse{Entry: fineEntryToProto(*entry), Balance: balance}, nil
+}
+
+func (s *FineService) WaiveFine(ctx context.Context, req *pb.WaiveFineRequest) (*pb.WaiveFineResponse, error) {
+	userID, err := primitive.ObjectIDFromHex(req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+	}
+
+	adminID, err := RequireAdmin(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, balance, err := s.settle(ctx, userID, models.FineEntry{
+		UserID:    userID,
+		Type:      models.FineEntryWaiver,
+		Amount:    req.Amount,
+		Note:      req.Note,
+		CreatedBy: &adminID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.WaiveFineResponse{Entry: fineEntryToProto(*entry), Balance: balance}, nil
+}
+
+// AccrueOverdueFines brings the overdue charge of every open, overdue loan up
+// to date.
+func (s *FineService) AccrueOverdueFines(ctx context.Context) (int, error) {
+	now := time.Now()
+	cursor, err := s.db.Collection("borrowed_books").Find(ctx, bson.M{
+		"return_date": nil,
+		"due_date":    bson.M{"$lt": now},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var loans []models.BorrowedBook
+	if err := cursor.All(ctx, &loans); err != nil {
+		return 0, err
+	}
+
+	accrued := 0
+	for _, loan := range loans {
+		if err := accrueLoanFine(ctx, s.db, loan, now); err != nil {
+			log.Printf("Error accruing fine for loan %s: %v", loan.ID.Hex(), err)
+			continue
+		}
+		accrued++
+	}
+
+	return accrued, nil
+}
+
+// settle records a payment or waiver against the user's outstanding balance.
+func (s *FineService) settle(ctx context.Context, userID primitive.ObjectID, entry models.FineEntry) (*models.FineEntry, int64, error) {
+	if entry.Amount <= 0 {
+		return nil, 0, status.Errorf(codes.InvalidArgument, "amount must be positive")
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, 0, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		balance, err := fineBalance(ctx, s.db, userID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to compute balance")
+		}
+		if entry.Amount > balance {
+			return nil, status.Errorf(codes.FailedPrecondition, "amount exceeds outstanding balance of %d", balance)
+		}
+
+		now := time.Now()
+		entry.CreatedAt = now
+		entry.UpdatedAt = now
+		insertResult, err := s.db.Collection("fines").InsertOne(ctx, entry)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record %s", entry.Type)
+		}
+		entry.ID = insertResult.InsertedID.(primitive.ObjectID)
+
+		return balance - entry.Amount, nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &entry, result.(int64), nil
+}
+
+// accrueLoanFine sets the overdue charge for a loan to the number of days,
+// started, between its due date and asOf times the daily fine of its loan
+// policy. The charge is upserted so repeated passes never double-charge.
+func accrueLoanFine(ctx context.Context, db *mongo.Database, loan models.BorrowedBook, asOf time.Time) error {
+	// Loans without a due date are checked once their terms are known.
+	if !loan.DueDate.IsZero() && !asOf.After(loan.DueDate) {
+		return nil
+	}
+
+	var book models.Title
+	if err := db.Collection("books").FindOne(ctx, bson.M{"_id": loan.BookID}).Decode(&book); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	var user models.User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": loan.UserID}).Decode(&user); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	terms, err := resolveLoanTerms(ctx, db, book.Category, user)
+	if err != nil {
+		return err
+	}
+
+	dueDate := loanDueDate(loan, terms)
+	if !asOf.After(dueDate) {
+		return nil
+	}
+
+	day := 24 * time.Hour
+	daysOverdue := int64((asOf.Sub(dueDate) + day - 1) / day)
+	amount := daysOverdue * terms.FinePerDay
+	if amount <= 0 {
+		return nil
+	}
+
+	_, err = db.Collection("fines").UpdateOne(
+		ctx,
+		bson.M{"loan_id": loan.ID, "type": models.FineEntryCharge},
+		bson.M{
+			"$set": bson.M{
+				"amount":     amount,
+				"updated_at": asOf,
+			},
+			"$setOnInsert": bson.M{
+				"user_id":    loan.UserID,
+				"note":       "overdue fine",
+				"created_at": asOf,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// fineBalance returns what a user currently owes.
+func fineBalance(ctx context.Context, db *mongo.Database, userID primitive.ObjectID) (int64, error) {
+	cursor, err := db.Collection("fines").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$type",
+			"amount": bson.M{"$sum": "$amount"},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var totals []struct {
+		Type   string `bson:"_id"`
+		Amount int64  `bson:"amount"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return 0, err
+	}
+
+	var balance int64
+	for _, total := range totals {
+		balance += signedFineAmount(models.FineEntry{Type: total.Type, Amount: total.Amount})
+	}
+	return balance, nil
+}
+
+// signedFineAmount is an entry's effect on the balance.
+func signedFineAmount(entry models.FineEntry) int64 {
+	if entry.Type == models.FineEntryCharge {
+		return entry.Amount
+	}
+	return -entry.Amount
+}
+
+func fineEntryToProto(entry models.FineEntry) *pb.FineEntry {
+	resp := &pb.FineEntry{
+		Id:        entry.ID.Hex(),
+		UserId:    entry.UserID.Hex(),
+		Type:      entry.Type,
+		Amount:    entry.Amount,
+		Note:      entry.Note,
+		CreatedAt: entry.CreatedAt.Format(time.RFC3339),
+	}
+	if entry.LoanID != nil {
+		resp.LoanId = entry.LoanID.Hex()
+	}
+	if entry.CreatedBy != nil {
+		resp.CreatedBy = entry.CreatedBy.Hex()
+	}
+	return resp
+}
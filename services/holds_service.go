@@ -0,0 +1,345 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+	"gc-buku/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// HoldPickupDays is how long a returned book stays on the hold shelf for the
+// patron at the head of the queue.
+const HoldPickupDays = 3
+
+type HoldService struct {
+	db *mongo.Database
+}
+
+func NewHoldService(db *mongo.Database) *HoldService {
+	return &HoldService{db: db}
+}
+
+func (s *HoldService) PlaceHold(ctx context.Context, req *pb.PlaceHoldRequest) (*pb.PlaceHoldResponse, error) {
+	bookID, err := primitive.ObjectIDFromHex(req.BookId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
+	}
+
+	userID, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		var book models.Title
+		err := s.db.Collection("books").FindOne(ctx, bson.M{"_id": bookID}).Decode(&book)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.NotFound, "book not found")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to fetch book")
+		}
+
+		if book.AvailableCopies > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "book is available, borrow it instead")
+		}
+
+		borrowed, err := s.db.Collection("borrowed_books").CountDocuments(ctx, bson.M{
+			"book_id":     bookID,
+			"user_id":     userID,
+			"return_date": nil,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check loans")
+		}
+		if borrowed > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "book is already borrowed by this user")
+		}
+
+		existing, err := s.db.Collection("holds").CountDocuments(ctx, bson.M{
+			"book_id": bookID,
+			"user_id": userID,
+			"status":  bson.M{"$in": bson.A{models.HoldStatusWaiting, models.HoldStatusReady}},
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check holds")
+		}
+		if existing > 0 {
+			return nil, status.Errorf(codes.AlreadyExists, "user already has a hold on this book")
+		}
+
+		hold := models.Hold{
+			BookID:    bookID,
+			UserID:    userID,
+			Status:    models.HoldStatusWaiting,
+			CreatedAt: time.Now(),
+		}
+
+		insertResult, err := s.db.Collection("holds").InsertOne(ctx, hold)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create hold")
+		}
+
+		hold.ID = insertResult.InsertedID.(primitive.ObjectID)
+		return &hold, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := s.holdToProto(ctx, *result.(*models.Hold))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to compute queue position")
+	}
+
+	return &pb.PlaceHoldResponse{Hold: hold}, nil
+}
+
+func (s *HoldService) CancelHold(ctx context.Context, req *pb.CancelHoldRequest) (*pb.CancelHoldResponse, error) {
+	holdID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid hold ID")
+	}
+
+	filter := bson.M{
+		"_id":    holdID,
+		"status": bson.M{"$in": bson.A{models.HoldStatusWaiting, models.HoldStatusReady}},
+	}
+	// Staff can cancel anyone's hold, patrons only their own
+	if !callerCan(ctx, utils.PermLoansManage) {
+		userID, err := callerID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		filter["user_id"] = userID
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		var hold models.Hold
+		err := s.db.Collection("holds").FindOneAndUpdate(
+			ctx,
+			filter,
+			bson.M{"$set": bson.M{"status": models.HoldStatusCancelled}},
+		).Decode(&hold)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.NotFound, "hold not found or no longer active")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to cancel hold")
+		}
+
+		// A ready hold was holding a copy on the shelf; pass it on.
+		if hold.Status == models.HoldStatusReady {
+			if err := advanceHoldQueue(ctx, s.db, hold.BookID, hold.ItemID); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to advance hold queue")
+			}
+		}
+
+		hold.Status = models.HoldStatusCancelled
+		return &hold, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := s.holdToProto(ctx, *result.(*models.Hold))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to compute queue position")
+	}
+
+	return &pb.CancelHoldResponse{Hold: hold}, nil
+}
+
+func (s *HoldService) ListHolds(ctx context.Context, req *pb.ListHoldsRequest) (*pb.ListHoldsResponse, error) {
+	caller, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{}
+	if req.BookId != "" {
+		bookID, err := primitive.ObjectIDFromHex(req.BookId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
+		}
+		filter["book_id"] = bookID
+	}
+	if req.UserId != "" {
+		userID, err := primitive.ObjectIDFromHex(req.UserId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+		}
+		if userID != caller && !callerCan(ctx, utils.PermLoansManage) {
+			return nil, status.Errorf(codes.PermissionDenied, "cannot view another user's holds")
+		}
+		filter["user_id"] = userID
+	}
+	if len(filter) == 0 {
+		filter["user_id"] = caller
+	}
+	if req.Status != "" {
+		filter["status"] = req.Status
+	}
+
+	cursor, err := s.db.Collection("holds").Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list holds")
+	}
+
+	var holds []models.Hold
+	if err := cursor.All(ctx, &holds); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode holds")
+	}
+
+	resp := &pb.ListHoldsResponse{}
+	for _, hold := range holds {
+		pbHold, err := s.holdToProto(ctx, hold)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to compute queue position")
+		}
+		resp.Holds = append(resp.Holds, pbHold)
+	}
+
+	return resp, nil
+}
+
+// ExpireReadyHolds expires holds that were not collected from the hold shelf
+// in time and offers each copy to the next patron in its book's queue.
+func (s *HoldService) ExpireReadyHolds(ctx context.Context) (int, error) {
+	cursor, err := s.db.Collection("holds").Find(ctx, bson.M{
+		"status":     models.HoldStatusReady,
+		"expires_at": bson.M{"$lt": time.Now()},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var holds []models.Hold
+	if err := cursor.All(ctx, &holds); err != nil {
+		return 0, err
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.EndSession(ctx)
+
+	expired := 0
+	for _, hold := range holds {
+		_, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+			result, err := s.db.Collection("holds").UpdateOne(
+				ctx,
+				bson.M{"_id": hold.ID, "status": models.HoldStatusReady},
+				bson.M{"$set": bson.M{"status": models.HoldStatusExpired}},
+			)
+			if err != nil {
+				return nil, err
+			}
+			if result.ModifiedCount == 0 {
+				return nil, nil
+			}
+			return nil, advanceHoldQueue(ctx, s.db, hold.BookID, hold.ItemID)
+		})
+		if err != nil {
+			log.Printf("Error expiring hold %s: %v", hold.ID.Hex(), err)
+			continue
+		}
+		expired++
+	}
+
+	return expired, nil
+}
+
+func (s *HoldService) holdToProto(ctx context.Context, hold models.Hold) (*pb.Hold, error) {
+	resp := &pb.Hold{
+		Id:        hold.ID.Hex(),
+		BookId:    hold.BookID.Hex(),
+		UserId:    hold.UserID.Hex(),
+		Status:    hold.Status,
+		CreatedAt: hold.CreatedAt.Format(time.RFC3339),
+	}
+	if hold.ReadyAt != nil {
+		resp.ReadyAt = hold.ReadyAt.Format(time.RFC3339)
+	}
+	if hold.ExpiresAt != nil {
+		resp.ExpiresAt = hold.ExpiresAt.Format(time.RFC3339)
+	}
+
+	if hold.Status == models.HoldStatusWaiting {
+		ahead, err := s.db.Collection("holds").CountDocuments(ctx, bson.M{
+			"book_id":    hold.BookID,
+			"status":     models.HoldStatusWaiting,
+			"created_at": bson.M{"$lt": hold.CreatedAt},
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp.Position = int32(ahead) + 1
+	}
+
+	return resp, nil
+}
+
+// advanceHoldQueue puts a copy of a book that has just come back on the hold
+// shelf for the oldest waiting hold on the book, or makes it available when
+// nobody is waiting. It must run inside the caller's transaction.
+func advanceHoldQueue(ctx context.Context, db *mongo.Database, bookID, itemID primitive.ObjectID) error {
+	now := time.Now()
+	expiresAt := now.Add(HoldPickupDays * 24 * time.Hour)
+
+	var next models.Hold
+	err := db.Collection("holds").FindOneAndUpdate(
+		ctx,
+		bson.M{"book_id": bookID, "status": models.HoldStatusWaiting},
+		bson.M{"$set": bson.M{
+			"status":     models.HoldStatusReady,
+			"item_id":    itemID,
+			"ready_at":   now,
+			"expires_at": expiresAt,
+		}},
+		options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}),
+	).Decode(&next)
+
+	update := bson.M{
+		"status":  models.ItemStatusOnHoldShelf,
+		"user_id": next.UserID,
+	}
+	if err == mongo.ErrNoDocuments {
+		update = bson.M{
+			"status":  models.ItemStatusAvailable,
+			"user_id": nil,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := db.Collection("items").UpdateOne(ctx, bson.M{"_id": itemID}, bson.M{"$set": update}); err != nil {
+		return err
+	}
+	return refreshTitleAvailability(ctx, db, bookID)
+}
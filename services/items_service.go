@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// shelvedItemStatuses are the statuses of copies that are neither on loan nor
+// reserved, which staff can move between and delete.
+var shelvedItemStatuses = bson.A{models.ItemStatusAvailable, models.ItemStatusMaintenance, models.ItemStatusLost}
+
+type ItemService struct {
+	db *mongo.Database
+}
+
+func NewItemService(db *mongo.Database) *ItemService {
+	return &ItemService{db: db}
+}
+
+// CreateItem adds a copy of a book. The new copy goes to the oldest waiting
+// hold on the book, if there is one.
+func (s *ItemService) CreateItem(ctx context.Context, req *pb.CreateItemRequest) (*pb.CreateItemResponse, error) {
+	bookID, err := primitive.ObjectIDFromHex(req.BookId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
+	}
+
+	var violations fieldViolations
+	item := newItem(&violations, "item", bookID, req.Item)
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		count, err := s.db.Collection("books").CountDocuments(ctx, bson.M{"_id": bookID})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch book")
+		}
+		if count == 0 {
+			return nil, status.Errorf(codes.NotFound, "book not found")
+		}
+
+		if _, err := s.db.Collection("items").InsertOne(ctx, item); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return nil, status.Errorf(codes.AlreadyExists, "barcode %q is already in use", item.Barcode)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to create item")
+		}
+
+		if err := advanceHoldQueue(ctx, s.db, bookID, item.ID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to shelve item")
+		}
+
+		var created models.Item
+		if err := s.db.Collection("items").FindOne(ctx, bson.M{"_id": item.ID}).Decode(&created); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch item")
+		}
+		return &created, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CreateItemResponse{Item: itemToProto(*result.(*models.Item))}, nil
+}
+
+func (s *ItemService) ListItems(ctx context.Context, req *pb.ListItemsRequest) (*pb.ListItemsResponse, error) {
+	bookID, err := primitive.ObjectIDFromHex(req.BookId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid book ID")
+	}
+
+	filter := bson.M{"title_id": bookID}
+	if req.Status != "" {
+		filter["status"] = req.Status
+	}
+
+	cursor, err := s.db.Collection("items").Find(ctx, filter, options.Find().SetSort(bson.M{"barcode": 1}))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list items")
+	}
+
+	var items []models.Item
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode items")
+	}
+
+	resp := &pb.ListItemsResponse{}
+	for _, item := range items {
+		resp.Items = append(resp.Items, itemToProto(item))
+	}
+	return resp, nil
+}
+
+// UpdateItem changes a copy's location, condition or status. Copies on loan
+// or on the hold shelf keep their status until they are returned or
+// collected.
+func (s *ItemService) UpdateItem(ctx context.Context, req *pb.UpdateItemRequest) (*pb.UpdateItemResponse, error) {
+	itemID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid item ID")
+	}
+
+	var violations fieldViolations
+	set := bson.M{}
+	if req.Location != nil {
+		location := strings.TrimSpace(*req.Location)
+		validateLocation(&violations, "location", location)
+		set["location"] = location
+	}
+	if req.Condition != nil {
+		validateItemCondition(&violations, "condition", *req.Condition)
+		set["condition"] = *req.Condition
+	}
+	if req.Status != nil {
+		switch *req.Status {
+		case models.ItemStatusAvailable, models.ItemStatusMaintenance, models.ItemStatusLost:
+		default:
+			violations.add("status", "status must be available, maintenance or lost")
+		}
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		var item models.Item
+		if err := s.db.Collection("items").FindOne(ctx, bson.M{"_id": itemID}).Decode(&item); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.NotFound, "item not found")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to fetch item")
+		}
+
+		statusChanged := req.Status != nil && *req.Status != item.Status
+		if statusChanged && !isShelved(item.Status) {
+			return nil, status.Errorf(codes.FailedPrecondition, "item is %s", item.Status)
+		}
+
+		if len(set) > 0 {
+			if _, err := s.db.Collection("items").UpdateOne(ctx, bson.M{"_id": itemID}, bson.M{"$set": set}); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to update item")
+			}
+		}
+
+		if statusChanged {
+			var err error
+			// A copy back in circulation is offered to the hold queue first.
+			if *req.Status == models.ItemStatusAvailable {
+				err = advanceHoldQueue(ctx, s.db, item.TitleID, itemID)
+			} else {
+				_, err = s.db.Collection("items").UpdateOne(ctx, bson.M{"_id": itemID}, bson.M{
+					"$set": bson.M{"status": *req.Status},
+				})
+				if err == nil {
+					err = refreshTitleAvailability(ctx, s.db, item.TitleID)
+				}
+			}
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to update item status")
+			}
+		}
+
+		if err := s.db.Collection("items").FindOne(ctx, bson.M{"_id": itemID}).Decode(&item); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch item")
+		}
+		return &item, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateItemResponse{Item: itemToProto(*result.(*models.Item))}, nil
+}
+
+// DeleteItem removes a copy that is neither on loan nor on the hold shelf.
+func (s *ItemService) DeleteItem(ctx context.Context, req *pb.DeleteItemRequest) (*pb.DeleteItemResponse, error) {
+	itemID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid item ID")
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		var item models.Item
+		if err := s.db.Collection("items").FindOne(ctx, bson.M{"_id": itemID}).Decode(&item); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.NotFound, "item not found")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to fetch item")
+		}
+		if !isShelved(item.Status) {
+			return nil, status.Errorf(codes.FailedPrecondition, "item is %s", item.Status)
+		}
+
+		if _, err := s.db.Collection("items").DeleteOne(ctx, bson.M{"_id": itemID}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete item")
+		}
+		if err := refreshTitleAvailability(ctx, s.db, item.TitleID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update book availability")
+		}
+		return nil, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteItemResponse{Id: req.Id}, nil
+}
+
+// newItem builds an available copy of titleID from req, recording problems
+// with its fields under field.
+func newItem(v *fieldViolations, field string, titleID primitive.ObjectID, req *pb.Item) models.Item {
+	if req == nil {
+		req = &pb.Item{}
+	}
+
+	item := models.Item{
+		ID:        primitive.NewObjectID(),
+		TitleID:   titleID,
+		Barcode:   strings.TrimSpace(req.Barcode),
+		Location:  strings.TrimSpace(req.Location),
+		Condition: req.Condition,
+		Status:    models.ItemStatusAvailable,
+		CreatedAt: time.Now(),
+	}
+	if item.Barcode == "" {
+		item.Barcode = defaultBarcode(item.ID)
+	} else {
+		validateBarcode(v, field+".barcode", item.Barcode)
+	}
+	if item.Condition == "" {
+		item.Condition = models.ItemConditionGood
+	}
+	validateLocation(v, field+".location", item.Location)
+	validateItemCondition(v, field+".condition", item.Condition)
+
+	return item
+}
+
+// defaultBarcode is the barcode of copies added without one.
+func defaultBarcode(id primitive.ObjectID) string {
+	return strings.ToUpper(id.Hex())
+}
+
+func isShelved(itemStatus string) bool {
+	for _, s := range shelvedItemStatuses {
+		if s == itemStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshTitleAvailability recomputes a title's status and copy counts from
+// its items. Lost copies do not count towards the total. It must run inside
+// the transaction that changed the items.
+func refreshTitleAvailability(ctx context.Context, db *mongo.Database, titleID primitive.ObjectID) error {
+	cursor, err := db.Collection("items").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"title_id": titleID}}},
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var groups []struct {
+		Status string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	total := 0
+	for _, group := range groups {
+		counts[group.Status] = group.Count
+		if group.Status != models.ItemStatusLost {
+			total += group.Count
+		}
+	}
+
+	titleStatus := models.TitleStatusUnavailable
+	switch {
+	case counts[models.ItemStatusAvailable] > 0:
+		titleStatus = models.TitleStatusAvailable
+	case counts[models.ItemStatusOnHoldShelf] > 0:
+		titleStatus = models.TitleStatusOnHoldShelf
+	case counts[models.ItemStatusBorrowed]+counts[models.ItemStatusOverdue] > 0:
+		titleStatus = models.TitleStatusBorrowed
+	}
+
+	_, err = db.Collection("books").UpdateOne(ctx, bson.M{"_id": titleID}, bson.M{"$set": bson.M{
+		"status":           titleStatus,
+		"total_copies":     total,
+		"available_copies": counts[models.ItemStatusAvailable],
+	}})
+	return err
+}
+
+func itemToProto(item models.Item) *pb.Item {
+	return &pb.Item{
+		Id:        item.ID.Hex(),
+		BookId:    item.TitleID.Hex(),
+		Barcode:   item.Barcode,
+		Location:  item.Location,
+		Condition: item.Condition,
+		Status:    item.Status,
+		CreatedAt: item.CreatedAt.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"gc-buku/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Loan terms used when no policy in the loan_policies collection sets them.
+const (
+	DefaultLoanDays         = 14
+	DefaultMaxRenewals      = 2
+	DefaultRenewalGraceDays = 0
+	DefaultFinePerDay       = 1000
+	DefaultMaxLoans         = 5
+	DefaultMaxFineBalance   = 10000
+	DefaultBlockOverdue     = true
+)
+
+var loanPolicyRank = map[string]int{
+	models.LoanPolicyScopeDefault:    1,
+	models.LoanPolicyScopeCategory:   2,
+	models.LoanPolicyScopeMembership: 3,
+	models.LoanPolicyScopeRole:       4,
+}
+
+// loanTerms are the effective terms for a single loan.
+type loanTerms struct {
+	Period       time.Duration
+	MaxRenewals  int
+	RenewalGrace time.Duration
+	FinePerDay   int64
+
+	MaxLoans       int
+	MaxFineBalance int64
+	BlockOverdue   bool
+}
+
+// loanDueDate returns when loan is due under terms. Loans made before loans
+// had due dates, if the backfill migration has not reached them, are due a
+// loan period after they were borrowed.
+func loanDueDate(loan models.BorrowedBook, terms loanTerms) time.Time {
+	if loan.DueDate.IsZero() {
+		return loan.BorrowedDate.Add(terms.Period)
+	}
+	return loan.DueDate
+}
+
+// resolveLoanTerms merges the policies that apply to a book category and a
+// user. Each field comes from the most specific policy that sets it: role
+// overrides beat membership overrides, which beat category overrides, which
+// beat the default policy.
+func resolveLoanTerms(ctx context.Context, db *mongo.Database, category string, user models.User) (loanTerms, error) {
+	role, membership := user.Role, userMembershipType(user)
+	scopes := bson.A{
+		bson.M{"scope": models.LoanPolicyScopeDefault},
+		bson.M{"scope": models.LoanPolicyScopeMembership, "key": membership},
+	}
+	if category != "" {
+		scopes = append(scopes, bson.M{"scope": models.LoanPolicyScopeCategory, "key": category})
+	}
+	if role != "" {
+		scopes = append(scopes, bson.M{"scope": models.LoanPolicyScopeRole, "key": role})
+	}
+
+	cursor, err := db.Collection("loan_policies").Find(ctx, bson.M{"$or": scopes})
+	if err != nil {
+		return loanTerms{}, err
+	}
+
+	var policies []models.LoanPolicy
+	if err := cursor.All(ctx, &policies); err != nil {
+		return loanTerms{}, err
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return loanPolicyRank[policies[i].Scope] < loanPolicyRank[policies[j].Scope]
+	})
+
+	loanDays, maxRenewals, graceDays := DefaultLoanDays, DefaultMaxRenewals, DefaultRenewalGraceDays
+	finePerDay := int64(DefaultFinePerDay)
+	maxLoans, maxFineBalance, blockOverdue := DefaultMaxLoans, int64(DefaultMaxFineBalance), DefaultBlockOverdue
+	for _, policy := range policies {
+		if policy.LoanDays != nil {
+			loanDays = *policy.LoanDays
+		}
+		if policy.MaxRenewals != nil {
+			maxRenewals = *policy.MaxRenewals
+		}
+		if policy.RenewalGraceDays != nil {
+			graceDays = *policy.RenewalGraceDays
+		}
+		if policy.FinePerDay != nil {
+			finePerDay = *policy.FinePerDay
+		}
+		if policy.MaxLoans != nil {
+			maxLoans = *policy.MaxLoans
+		}
+		if policy.MaxFineBalance != nil {
+			maxFineBalance = *policy.MaxFineBalance
+		}
+		if policy.BlockOverdue != nil {
+			blockOverdue = *policy.BlockOverdue
+		}
+	}
+
+	return loanTerms{
+		Period:       time.Duration(loanDays) * 24 * time.Hour,
+		MaxRenewals:  maxRenewals,
+		RenewalGrace: time.Duration(graceDays) * 24 * time.Hour,
+		FinePerDay:   finePerDay,
+
+		MaxLoans:       maxLoans,
+		MaxFineBalance: maxFineBalance,
+		BlockOverdue:   blockOverdue,
+	}, nil
+}
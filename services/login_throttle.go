@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"gc-buku/models"
+	"gc-buku/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// LoginAttemptWindow is how long failed logins are remembered after the last
+// one.
+const LoginAttemptWindow = 15 * time.Minute
+
+// loginThrottlePolicy controls how failed logins for one key are slowed down.
+// From BackoffAfter failures on, each failure doubles the wait before the
+// next attempt, up to MaxBackoff; at LockAfter failures the key is locked for
+// LockFor.
+type loginThrottlePolicy struct {
+	BackoffAfter int
+	MaxBackoff   time.Duration
+	LockAfter    int
+	LockFor      time.Duration
+	// LockedCode is returned while the key is locked.
+	LockedCode codes.Code
+}
+
+var (
+	usernameThrottle = loginThrottlePolicy{
+		BackoffAfter: 3,
+		MaxBackoff:   5 * time.Minute,
+		LockAfter:    10,
+		LockFor:      15 * time.Minute,
+		LockedCode:   codes.PermissionDenied,
+	}
+	// A client IP may try more usernames before it is cut off, but not
+	// enough to make guessing across many accounts worthwhile.
+	clientIPThrottle = loginThrottlePolicy{
+		BackoffAfter: 10,
+		MaxBackoff:   5 * time.Minute,
+		LockAfter:    50,
+		LockFor:      time.Hour,
+		LockedCode:   codes.ResourceExhausted,
+	}
+)
+
+func usernameThrottleKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func clientIPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLoginThrottle returns an error if key is locked out or still has to
+// wait before its next attempt.
+func checkLoginThrottle(ctx context.Context, db *mongo.Database, key string, policy loginThrottlePolicy) error {
+	var attempt models.LoginAttempt
+	err := db.Collection("login_attempts").FindOne(ctx, bson.M{"_id": key}).Decode(&attempt)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check login attempts")
+	}
+
+	now := time.Now()
+	if attempt.LockedUntil != nil && attempt.LockedUntil.After(now) {
+		if policy.LockedCode == codes.PermissionDenied {
+			return status.Errorf(codes.PermissionDenied, "account is locked until %s", attempt.LockedUntil.Format(time.RFC3339))
+		}
+		return status.Errorf(policy.LockedCode, "too many failed logins, try again after %s", attempt.LockedUntil.Format(time.RFC3339))
+	}
+	if attempt.RetryAfter != nil && attempt.RetryAfter.After(now) {
+		wait := int(math.Ceil(attempt.RetryAfter.Sub(now).Seconds()))
+		return status.Errorf(codes.ResourceExhausted, "too many failed logins, retry in %d seconds", wait)
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login for key and applies the policy's
+// backoff and lockout.
+func recordLoginFailure(ctx context.Context, db *mongo.Database, key string, policy loginThrottlePolicy) error {
+	now := time.Now()
+	expiresAt := now.Add(LoginAttemptWindow)
+
+	// Start counting again when the previous failures have been forgotten.
+	var attempt models.LoginAttempt
+	err := db.Collection("login_attempts").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": key},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$expires_at", now}},
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+				1,
+			}},
+			"last_failure_at": now,
+			"expires_at":      bson.M{"$max": bson.A{"$expires_at", expiresAt}},
+		}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&attempt)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{}
+	switch {
+	case attempt.Failures >= policy.LockAfter:
+		lockedUntil := now.Add(policy.LockFor)
+		set["locked_until"] = lockedUntil
+		set["failures"] = 0
+		if lockedUntil.After(attempt.ExpiresAt) {
+			set["expires_at"] = lockedUntil.Add(LoginAttemptWindow)
+		}
+	case attempt.Failures >= policy.BackoffAfter:
+		backoff := time.Duration(math.Pow(2, float64(attempt.Failures-policy.BackoffAfter))) * time.Second
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+		set["retry_after"] = now.Add(backoff)
+	default:
+		return nil
+	}
+
+	_, err = db.Collection("login_attempts").UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": set})
+	return err
+}
+
+// clearLoginFailures forgets the failed logins and any lockout of key.
+func clearLoginFailures(ctx context.Context, db *mongo.Database, key string) error {
+	_, err := db.Collection("login_attempts").DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+// clientIP is the address of the end user making the call: the first
+// x-forwarded-for entry set by the REST gateway, or the peer address for
+// everyone else. x-forwarded-for is only trusted from callers presenting
+// gatewaySecret, as anyone could set it; with no secret it never is.
+func clientIP(ctx context.Context, gatewaySecret string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && fromGateway(md, gatewaySecret) {
+		if values := md.Get("x-forwarded-for"); len(values) > 0 {
+			if ip := strings.TrimSpace(strings.Split(values[0], ",")[0]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+func fromGateway(md metadata.MD, gatewaySecret string) bool {
+	values := md.Get(utils.GatewaySecretMetadata)
+	return gatewaySecret != "" && len(values) > 0 &&
+		subtle.ConstantTimeCompare([]byte(values[0]), []byte(gatewaySecret)) == 1
+}
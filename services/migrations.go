@@ -0,0 +1,321 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migration upgrades documents written by an older version of the server.
+type migration struct {
+	name string
+	up   func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations run in order, each once per database, before indexes are
+// built. Applied migrations are recorded in schema_migrations.
+var migrations = []migration{
+	{name: "0001_split_books_into_items", up: splitBooksIntoItems},
+	{name: "0002_link_book_authors", up: linkBookAuthors},
+	{name: "0003_backfill_renewal_counts", up: backfillRenewalCounts},
+	{name: "0004_backfill_due_dates", up: backfillDueDates},
+	{name: "0005_check_duplicate_usernames", up: checkDuplicateUsernames},
+	{name: "0006_merge_duplicate_authors", up: mergeDuplicateAuthors},
+}
+
+// RunMigrations applies the migrations that have not yet run against db.
+func RunMigrations(ctx context.Context, db *mongo.Database) error {
+	for _, m := range migrations {
+		applied, err := db.Collection("schema_migrations").CountDocuments(ctx, bson.M{"_id": m.name})
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
+
+		log.Printf("Running migration %s", m.name)
+		if err := m.up(ctx, db); err != nil {
+			return fmt.Errorf("migration %s: %v", m.name, err)
+		}
+
+		_, err = db.Collection("schema_migrations").InsertOne(ctx, bson.M{
+			"_id":        m.name,
+			"applied_at": time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitBooksIntoItems turns each book written before books had copies into a
+// title with a single copy. The copy takes over the book's status and
+// borrower, and the book's loans and ready holds are pointed at it. Books are
+// converted one transaction at a time, so an interrupted run can be resumed.
+func splitBooksIntoItems(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("books").Find(ctx, bson.M{"total_copies": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+
+	var books []struct {
+		ID     primitive.ObjectID `bson:"_id"`
+		Status string             `bson:"status"`
+		UserID primitive.ObjectID `bson:"user_id,omitempty"`
+	}
+	if err := cursor.All(ctx, &books); err != nil {
+		return err
+	}
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	for _, book := range books {
+		item := models.Item{
+			ID:        primitive.NewObjectID(),
+			TitleID:   book.ID,
+			Condition: models.ItemConditionGood,
+			Status:    book.Status,
+			CreatedAt: time.Now(),
+		}
+		item.Barcode = defaultBarcode(item.ID)
+		switch book.Status {
+		case models.ItemStatusBorrowed, models.ItemStatusOverdue, models.ItemStatusOnHoldShelf:
+			item.UserID = book.UserID
+		default:
+			item.Status = models.ItemStatusAvailable
+		}
+
+		_, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+			if _, err := db.Collection("items").InsertOne(ctx, item); err != nil {
+				return nil, err
+			}
+
+			_, err := db.Collection("borrowed_books").UpdateMany(
+				ctx,
+				bson.M{"book_id": book.ID, "item_id": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"item_id": item.ID}},
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = db.Collection("holds").UpdateMany(
+				ctx,
+				bson.M{"book_id": book.ID, "status": models.HoldStatusReady},
+				bson.M{"$set": bson.M{"item_id": item.ID}},
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = db.Collection("books").UpdateOne(ctx, bson.M{"_id": book.ID}, bson.M{"$unset": bson.M{"user_id": ""}})
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, refreshTitleAvailability(ctx, db, book.ID)
+		})
+		if err != nil {
+			return fmt.Errorf("book %s: %v", book.ID.Hex(), err)
+		}
+	}
+
+	log.Printf("Split %d books into titles and items", len(books))
+	return nil
+}
+
+// linkBookAuthors credits each book written before authors existed to the
+// author named by its author string, creating authors as needed. Authors
+// spelled differently end up as separate authors, to be merged by hand.
+func linkBookAuthors(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("books").Find(ctx, bson.M{
+		"contributors": bson.M{"$exists": false},
+		"author":       bson.M{"$nin": bson.A{"", nil}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var books []models.Title
+	if err := cursor.All(ctx, &books); err != nil {
+		return err
+	}
+
+	for _, book := range books {
+		name := strings.TrimSpace(book.Author)
+		if name == "" {
+			continue
+		}
+
+		author, err := findOrCreateAuthor(ctx, db, name)
+		if err != nil {
+			return fmt.Errorf("book %s: %v", book.ID.Hex(), err)
+		}
+
+		contributors := []models.Contributor{{AuthorID: author.ID, Name: author.Name, Role: models.ContributorRoleAuthor}}
+		_, err = db.Collection("books").UpdateOne(ctx, bson.M{"_id": book.ID}, bson.M{"$set": bson.M{
+			"contributors": contributors,
+			"author":       contributorsDisplay(contributors),
+		}})
+		if err != nil {
+			return fmt.Errorf("book %s: %v", book.ID.Hex(), err)
+		}
+	}
+
+	log.Printf("Linked %d books to authors", len(books))
+	return nil
+}
+
+// backfillRenewalCounts sets renewal_count on loans made before loans could
+// be renewed. Renewals match the count they read, and a missing field never
+// matches 0.
+func backfillRenewalCounts(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("borrowed_books").UpdateMany(ctx,
+		bson.M{"renewal_count": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"renewal_count": 0}},
+	)
+	return err
+}
+
+// backfillDueDates gives loans made before loans had due dates the due date
+// they would have had: the borrowed date plus the loan period of the terms
+// that apply to the book and borrower now, or DefaultLoanDays if either is
+// gone. Overdue checks, fines and renewals all go by the due date.
+func backfillDueDates(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("borrowed_books").Find(ctx, bson.M{"due_date": nil})
+	if err != nil {
+		return err
+	}
+
+	var loans []models.BorrowedBook
+	if err := cursor.All(ctx, &loans); err != nil {
+		return err
+	}
+
+	for _, loan := range loans {
+		period := time.Duration(DefaultLoanDays) * 24 * time.Hour
+
+		var book models.Title
+		var user models.User
+		bookErr := db.Collection("books").FindOne(ctx, bson.M{"_id": loan.BookID}).Decode(&book)
+		userErr := db.Collection("users").FindOne(ctx, bson.M{"_id": loan.UserID}).Decode(&user)
+		for _, err := range []error{bookErr, userErr} {
+			if err != nil && err != mongo.ErrNoDocuments {
+				return fmt.Errorf("loan %s: %v", loan.ID.Hex(), err)
+			}
+		}
+		if bookErr == nil && userErr == nil {
+			terms, err := resolveLoanTerms(ctx, db, book.Category, user)
+			if err != nil {
+				return fmt.Errorf("loan %s: %v", loan.ID.Hex(), err)
+			}
+			period = terms.Period
+		}
+
+		_, err = db.Collection("borrowed_books").UpdateOne(ctx,
+			bson.M{"_id": loan.ID, "due_date": nil},
+			bson.M{"$set": bson.M{"due_date": loan.BorrowedDate.Add(period)}},
+		)
+		if err != nil {
+			return fmt.Errorf("loan %s: %v", loan.ID.Hex(), err)
+		}
+	}
+
+	log.Printf("Set the due date of %d loans", len(loans))
+	return nil
+}
+
+// checkDuplicateUsernames fails, naming them, while usernames differ only in
+// case, which the unique username index cannot be built over. Which account
+// keeps a name is for an admin to decide, so none are renamed here.
+func checkDuplicateUsernames(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("users").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$username",
+			"users": bson.M{"$push": bson.M{"id": "$_id", "username": "$username"}},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetCollation(&options.Collation{Locale: "en", Strength: 2}))
+	if err != nil {
+		return err
+	}
+
+	var groups []struct {
+		Users []struct {
+			ID       primitive.ObjectID `bson:"id"`
+			Username string             `bson:"username"`
+		} `bson:"users"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	duplicates := make([]string, 0, len(groups))
+	for _, group := range groups {
+		users := make([]string, 0, len(group.Users))
+		for _, u := range group.Users {
+			users = append(users, fmt.Sprintf("%q (%s)", u.Username, u.ID.Hex()))
+		}
+		duplicates = append(duplicates, strings.Join(users, ", "))
+	}
+	return fmt.Errorf("usernames must be unique regardless of case; rename all but one user of each of: %s; "+
+		"e.g. db.users.updateOne({_id: ObjectId(\"...\")}, {$set: {username: \"...\"}}), then restart",
+		strings.Join(duplicates, "; "))
+}
+
+// mergeDuplicateAuthors merges authors whose names differ only in case, which
+// the unique author name index cannot be built over, into the oldest of them.
+func mergeDuplicateAuthors(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("authors").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": "$name",
+			"ids": bson.M{"$push": "$_id"},
+		}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+	}, options.Aggregate().SetCollation(authorCollation))
+	if err != nil {
+		return err
+	}
+
+	var groups []struct {
+		IDs []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+
+	authors := NewAuthorService(db)
+	for _, group := range groups {
+		req := &pb.MergeAuthorsRequest{TargetId: group.IDs[0].Hex()}
+		for _, id := range group.IDs[1:] {
+			req.SourceIds = append(req.SourceIds, id.Hex())
+		}
+		if _, err := authors.MergeAuthors(ctx, req); err != nil {
+			return fmt.Errorf("author %s: %v", req.TargetId, err)
+		}
+	}
+
+	log.Printf("Merged %d sets of authors with the same name", len(groups))
+	return nil
+}
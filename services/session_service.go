@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+	"gc-buku/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sessionTokens is the token pair handed out on login and refresh.
+type sessionTokens struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+type SessionService struct {
+	db *mongo.Database
+}
+
+func NewSessionService(db *mongo.Database) *SessionService {
+	return &SessionService{db: db}
+}
+
+// RefreshToken exchanges a refresh token for a new access token. The refresh
+// token is rotated, so each one can be used only once.
+func (s *SessionService) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "refresh token is required")
+	}
+
+	refreshToken, err := newSecretToken()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate refresh token")
+	}
+
+	now := time.Now()
+	var session models.Session
+	err = s.db.Collection("sessions").FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"refresh_token_hash": hashSecretToken(req.RefreshToken),
+			"revoked_at":         nil,
+			"expires_at":         bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{
+			"refresh_token_hash": hashSecretToken(refreshToken),
+			"last_used_at":       now,
+		}},
+	).Decode(&session)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid or expired refresh token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to refresh session")
+	}
+
+	// Read the user again so role changes apply from the next access token.
+	var user models.User
+	err = s.db.Collection("users").FindOne(ctx, bson.M{"_id": session.UserID}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.Unauthenticated, "user no longer exists")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to fetch user")
+	}
+
+	expiresAt := now.Add(utils.AccessTokenExpiry())
+	token, err := utils.GenerateToken(user.ID.Hex(), userRole(user), session.ID.Hex())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate token")
+	}
+
+	return &pb.RefreshTokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+	}, nil
+}
+
+// Logout revokes the caller's session, or every session of the caller when
+// all_devices is set. Access tokens of revoked sessions stop working at once.
+func (s *SessionService) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	identity, ok := utils.IdentityFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	userID, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"user_id": userID, "revoked_at": nil}
+	if !req.AllDevices {
+		sessionID, err := primitive.ObjectIDFromHex(identity.SessionID)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid session")
+		}
+		filter["_id"] = sessionID
+	}
+
+	result, err := s.db.Collection("sessions").UpdateMany(ctx, filter, bson.M{
+		"$set": bson.M{"revoked_at": time.Now()},
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke sessions")
+	}
+
+	return &pb.LogoutResponse{RevokedSessions: int32(result.ModifiedCount)}, nil
+}
+
+// ValidateSession reports who the caller is. The session itself is checked
+// by the auth interceptor, so reaching this method means it is still active.
+func (s *SessionService) ValidateSession(ctx context.Context, req *pb.ValidateSessionRequest) (*pb.ValidateSessionResponse, error) {
+	identity, ok := utils.IdentityFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+
+	return &pb.ValidateSessionResponse{
+		UserId: identity.UserID,
+		Role:   identity.Role,
+	}, nil
+}
+
+// SessionActive reports whether a session exists and has been neither
+// revoked nor expired.
+func (s *SessionService) SessionActive(ctx context.Context, id string) (bool, error) {
+	sessionID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, nil
+	}
+
+	count, err := s.db.Collection("sessions").CountDocuments(ctx, bson.M{
+		"_id":        sessionID,
+		"revoked_at": nil,
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// startSession records a new session for user and issues its tokens.
+func startSession(ctx context.Context, db *mongo.Database, user models.User) (*sessionTokens, error) {
+	refreshToken, err := newSecretToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		UserID:           user.ID,
+		RefreshTokenHash: hashSecretToken(refreshToken),
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(utils.RefreshTokenExpiry()),
+	}
+
+	result, err := db.Collection("sessions").InsertOne(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	session.ID = result.InsertedID.(primitive.ObjectID)
+
+	token, err := utils.GenerateToken(user.ID.Hex(), userRole(user), session.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionTokens{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    now.Add(utils.AccessTokenExpiry()),
+	}, nil
+}
+
+// newSecretToken returns a random, URL-safe token for refresh, password reset
+// and verification tokens.
+func newSecretToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecretToken is how secret tokens are stored. They are random, so a plain
+// SHA-256 is enough.
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,417 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gc-buku/models"
+	pb "gc-buku/proto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// subjectPathSeparator separates the subjects in a path from the top level
+// down, as in "Science -- Physics", the way MARC subject headings are written.
+const subjectPathSeparator = " -- "
+
+// subjectCollation makes subject names unique among their siblings ignoring
+// case. The subjects indexes use the same collation.
+var subjectCollation = &options.Collation{Locale: "en", Strength: 2}
+
+type SubjectService struct {
+	db *mongo.Database
+}
+
+func NewSubjectService(db *mongo.Database) *SubjectService {
+	return &SubjectService{db: db}
+}
+
+func (s *SubjectService) CreateSubject(ctx context.Context, req *pb.CreateSubjectRequest) (*pb.CreateSubjectResponse, error) {
+	if req.Subject == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "subject is required")
+	}
+
+	subject := models.Subject{
+		Name:      strings.TrimSpace(req.Subject.Name),
+		Ancestors: []primitive.ObjectID{},
+		CreatedAt: time.Now(),
+	}
+
+	var violations fieldViolations
+	validateSubjectName(&violations, "subject.name", subject.Name)
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	if req.Subject.ParentId != "" {
+		parentID, err := primitive.ObjectIDFromHex(req.Subject.ParentId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid parent ID")
+		}
+		parent, err := s.subject(ctx, parentID)
+		if err != nil {
+			return nil, err
+		}
+		subject.ParentID = parent.ID
+		subject.Ancestors = append(parent.Ancestors, parent.ID)
+	}
+
+	result, err := s.db.Collection("subjects").InsertOne(ctx, subject)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, status.Errorf(codes.AlreadyExists, "subject %q already exists here", subject.Name)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to create subject")
+	}
+	subject.ID = result.InsertedID.(primitive.ObjectID)
+
+	return &pb.CreateSubjectResponse{Subject: subjectToProto(subject)}, nil
+}
+
+func (s *SubjectService) ListSubjects(ctx context.Context, req *pb.ListSubjectsRequest) (*pb.ListSubjectsResponse, error) {
+	filter := bson.M{}
+	var parentID primitive.ObjectID
+	if req.ParentId != "" {
+		var err error
+		parentID, err = primitive.ObjectIDFromHex(req.ParentId)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid parent ID")
+		}
+	}
+
+	switch {
+	case req.Recursive && !parentID.IsZero():
+		filter["ancestors"] = parentID
+	case req.Recursive:
+	case !parentID.IsZero():
+		filter["parent_id"] = parentID
+	default:
+		filter["parent_id"] = bson.M{"$exists": false}
+	}
+
+	opts := options.Find().
+		SetCollation(subjectCollation).
+		SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.db.Collection("subjects").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list subjects")
+	}
+
+	var subjects []models.Subject
+	if err := cursor.All(ctx, &subjects); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode subjects")
+	}
+
+	resp := &pb.ListSubjectsResponse{}
+	for _, subject := range subjects {
+		resp.Subjects = append(resp.Subjects, subjectToProto(subject))
+	}
+	return resp, nil
+}
+
+// UpdateSubject renames a subject or moves it under another parent. Moving a
+// subject takes everything below it along.
+func (s *SubjectService) UpdateSubject(ctx context.Context, req *pb.UpdateSubjectRequest) (*pb.UpdateSubjectResponse, error) {
+	subjectID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid subject ID")
+	}
+
+	var violations fieldViolations
+	if req.Name != nil {
+		validateSubjectName(&violations, "name", strings.TrimSpace(*req.Name))
+	}
+	var parentID primitive.ObjectID
+	if req.ParentId != nil && *req.ParentId != "" {
+		if parentID, err = primitive.ObjectIDFromHex(*req.ParentId); err != nil {
+			violations.add("parent_id", "invalid parent ID")
+		}
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		subject, err := s.subject(ctx, subjectID)
+		if err != nil {
+			return nil, err
+		}
+
+		set := bson.M{}
+		unset := bson.M{}
+		if req.Name != nil {
+			subject.Name = strings.TrimSpace(*req.Name)
+			set["name"] = subject.Name
+		}
+
+		if req.ParentId != nil && parentID != subject.ParentID {
+			ancestors := []primitive.ObjectID{}
+			if parentID.IsZero() {
+				unset["parent_id"] = ""
+			} else {
+				parent, err := s.subject(ctx, parentID)
+				if err != nil {
+					return nil, err
+				}
+				if parent.ID == subject.ID || containsID(parent.Ancestors, subject.ID) {
+					return nil, status.Errorf(codes.InvalidArgument, "cannot move a subject below itself")
+				}
+				ancestors = append(parent.Ancestors, parent.ID)
+				set["parent_id"] = parent.ID
+			}
+			set["ancestors"] = ancestors
+
+			if err := s.moveDescendants(ctx, subject, ancestors); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to move subjects")
+			}
+			subject.ParentID = parentID
+			subject.Ancestors = ancestors
+		}
+
+		update := bson.M{}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		if len(update) > 0 {
+			if _, err := s.db.Collection("subjects").UpdateOne(ctx, bson.M{"_id": subjectID}, update); err != nil {
+				if mongo.IsDuplicateKeyError(err) {
+					return nil, status.Errorf(codes.AlreadyExists, "subject %q already exists here", subject.Name)
+				}
+				return nil, status.Errorf(codes.Internal, "failed to update subject")
+			}
+		}
+		return &subject, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateSubjectResponse{Subject: subjectToProto(*result.(*models.Subject))}, nil
+}
+
+// DeleteSubject removes a subject without subjects below it and files its
+// books under none.
+func (s *SubjectService) DeleteSubject(ctx context.Context, req *pb.DeleteSubjectRequest) (*pb.DeleteSubjectResponse, error) {
+	subjectID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid subject ID")
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		if _, err := s.subject(ctx, subjectID); err != nil {
+			return nil, err
+		}
+
+		children, err := s.db.Collection("subjects").CountDocuments(ctx, bson.M{"parent_id": subjectID})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check subjects")
+		}
+		if children > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "subject has %d subjects below it", children)
+		}
+
+		_, err = s.db.Collection("books").UpdateMany(
+			ctx,
+			bson.M{"subject_ids": subjectID},
+			bson.M{"$pull": bson.M{"subject_ids": subjectID}},
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update books")
+		}
+		if _, err := s.db.Collection("subjects").DeleteOne(ctx, bson.M{"_id": subjectID}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete subject")
+		}
+		return nil, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteSubjectResponse{Id: req.Id}, nil
+}
+
+func (s *SubjectService) subject(ctx context.Context, id primitive.ObjectID) (models.Subject, error) {
+	var subject models.Subject
+	if err := s.db.Collection("subjects").FindOne(ctx, bson.M{"_id": id}).Decode(&subject); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return subject, status.Errorf(codes.NotFound, "subject %s not found", id.Hex())
+		}
+		return subject, status.Errorf(codes.Internal, "failed to fetch subject")
+	}
+	return subject, nil
+}
+
+// moveDescendants rewrites the ancestors of everything below subject after it
+// has moved to sit below ancestors.
+func (s *SubjectService) moveDescendants(ctx context.Context, subject models.Subject, ancestors []primitive.ObjectID) error {
+	cursor, err := s.db.Collection("subjects").Find(ctx, bson.M{"ancestors": subject.ID})
+	if err != nil {
+		return err
+	}
+	var descendants []models.Subject
+	if err := cursor.All(ctx, &descendants); err != nil {
+		return err
+	}
+
+	depth := len(subject.Ancestors)
+	for _, d := range descendants {
+		moved := make([]primitive.ObjectID, 0, len(ancestors)+len(d.Ancestors)-depth)
+		moved = append(moved, ancestors...)
+		moved = append(moved, d.Ancestors[depth:]...)
+		_, err := s.db.Collection("subjects").UpdateOne(ctx, bson.M{"_id": d.ID}, bson.M{
+			"$set": bson.M{"ancestors": moved},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findOrCreateSubject returns the subject at path, whose parts are separated
+// by subjectPathSeparator, matching names ignoring case and creating any
+// subjects missing along the way. It returns the zero ID for a blank path.
+func findOrCreateSubject(ctx context.Context, db *mongo.Database, path string) (primitive.ObjectID, error) {
+	var parent models.Subject
+	for _, name := range strings.Split(path, subjectPathSeparator) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		var violations fieldViolations
+		validateSubjectName(&violations, "subjects", name)
+		if err := violations.err(); err != nil {
+			return primitive.NilObjectID, err
+		}
+
+		filter := bson.M{"name": name, "parent_id": bson.M{"$exists": false}}
+		subject := models.Subject{Name: name, Ancestors: []primitive.ObjectID{}, CreatedAt: time.Now()}
+		if !parent.ID.IsZero() {
+			filter["parent_id"] = parent.ID
+			subject.ParentID = parent.ID
+			subject.Ancestors = append(append([]primitive.ObjectID{}, parent.Ancestors...), parent.ID)
+		}
+
+		opts := options.FindOne().SetCollation(subjectCollation)
+		err := db.Collection("subjects").FindOne(ctx, filter, opts).Decode(&parent)
+		if err == mongo.ErrNoDocuments {
+			result, err := db.Collection("subjects").InsertOne(ctx, subject)
+			// Someone else may have just created it.
+			if mongo.IsDuplicateKeyError(err) {
+				err = db.Collection("subjects").FindOne(ctx, filter, opts).Decode(&parent)
+			} else if err == nil {
+				subject.ID = result.InsertedID.(primitive.ObjectID)
+				parent = subject
+			}
+			if err != nil {
+				return primitive.NilObjectID, status.Errorf(codes.Internal, "failed to create subject")
+			}
+		} else if err != nil {
+			return primitive.NilObjectID, status.Errorf(codes.Internal, "failed to fetch subject")
+		}
+	}
+	return parent.ID, nil
+}
+
+// subjectTree returns id and the IDs of every subject below it.
+func subjectTree(ctx context.Context, db *mongo.Database, id primitive.ObjectID) (bson.A, error) {
+	cursor, err := db.Collection("subjects").Find(
+		ctx,
+		bson.M{"ancestors": id},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var descendants []models.Subject
+	if err := cursor.All(ctx, &descendants); err != nil {
+		return nil, err
+	}
+
+	ids := bson.A{id}
+	for _, d := range descendants {
+		ids = append(ids, d.ID)
+	}
+	return ids, nil
+}
+
+// resolveSubjects checks that the subjects a book is filed under exist.
+func resolveSubjects(ctx context.Context, db *mongo.Database, field string, subjectIDs []string) ([]primitive.ObjectID, error) {
+	if len(subjectIDs) == 0 {
+		return nil, nil
+	}
+
+	var violations fieldViolations
+	ids := make([]primitive.ObjectID, 0, len(subjectIDs))
+	lookup := make(bson.A, 0, len(subjectIDs))
+	for i, hex := range subjectIDs {
+		id, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			violations.add(fmt.Sprintf("%s.subject_ids[%d]", field, i), "invalid subject ID")
+			continue
+		}
+		if !containsID(ids, id) {
+			ids = append(ids, id)
+			lookup = append(lookup, id)
+		}
+	}
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	count, err := db.Collection("subjects").CountDocuments(ctx, bson.M{"_id": bson.M{"$in": lookup}})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch subjects")
+	}
+	if int(count) != len(ids) {
+		violations.add(field+".subject_ids", "subject not found")
+		return nil, violations.err()
+	}
+	return ids, nil
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
+func subjectToProto(subject models.Subject) *pb.Subject {
+	resp := &pb.Subject{
+		Id:        subject.ID.Hex(),
+		Name:      subject.Name,
+		CreatedAt: subject.CreatedAt.Format(time.RFC3339),
+	}
+	if !subject.ParentID.IsZero() {
+		resp.ParentId = subject.ParentID.Hex()
+	}
+	resp.AncestorIds = idsToHex(subject.Ancestors)
+	return resp
+}
@@ -2,7 +2,16 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 
+	"gc-buku/mailer"
 	"gc-buku/models"
 	pb "gc-buku/proto"
 	"gc-buku/utils"
@@ -10,45 +19,104 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	defaultUserPageSize = 20
+	maxUserPageSize     = 100
+)
+
 type UserService struct {
-	db *mongo.Database
+	db     *mongo.Database
+	mailer mailer.Mailer
+	// appURL is the base URL of the REST API, used for links in emails.
+	appURL string
+	// gatewaySecret is shared with the REST gateway, which is trusted to
+	// forward the client IP of logins. Logins are only throttled per IP
+	// when it is set.
+	gatewaySecret string
 }
 
-func NewUserService(db *mongo.Database) *UserService {
-	return &UserService{db: db}
+func NewUserService(db *mongo.Database, mailer mailer.Mailer, appURL, gatewaySecret string) *UserService {
+	return &UserService{db: db, mailer: mailer, appURL: strings.TrimRight(appURL, "/"), gatewaySecret: gatewaySecret}
 }
 
 func (s *UserService) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	if req.User == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "user is required")
+	}
+
+	var violations fieldViolations
+	validateUsername(&violations, "user.username", req.User.Username)
+	validatePassword(&violations, "password", req.Password, req.User.Username)
+	email, err := normalizeEmail(req.User.Email)
+	if err != nil {
+		violations.add("user.email", "invalid email address")
+	}
+	displayName := strings.TrimSpace(req.User.DisplayName)
+	validateDisplayName(&violations, "user.display_name", displayName)
+	phone := strings.TrimSpace(req.User.Phone)
+	validatePhone(&violations, "user.phone", phone)
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	hash, err := utils.HashPassword(req.Password)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to hash password")
+	}
+
 	user := models.User{
-		Username: req.User.Username,
-		Password: req.User.Password,
+		Username:       req.User.Username,
+		Password:       hash,
+		Role:           models.RolePatron,
+		Email:          email,
+		DisplayName:    displayName,
+		Phone:          phone,
+		MembershipType: models.MembershipStandard,
+		CreatedAt:      time.Now(),
 	}
 
 	result, err := s.db.Collection("users").InsertOne(ctx, user)
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			if strings.Contains(err.Error(), "index: username_1 ") {
+				return nil, status.Errorf(codes.AlreadyExists, "username is already taken")
+			}
+			return nil, status.Errorf(codes.AlreadyExists, "email is already registered")
+		}
 		return nil, status.Errorf(codes.Internal, "failed to create user: %v", err)
 	}
 
-	objectID := result.InsertedID.(primitive.ObjectID)
-	return &pb.CreateUserResponse{
-		User: &pb.User{
-			Id:       objectID.Hex(),
-			Username: user.Username,
-			Password: user.Password,
-		},
-	}, nil
+	user.ID = result.InsertedID.(primitive.ObjectID)
+	if user.Email != "" {
+		if err := s.sendVerificationEmail(ctx, user); err != nil {
+			log.Printf("Error sending verification email to user %s: %v", user.ID.Hex(), err)
+		}
+	}
+
+	return &pb.CreateUserResponse{User: userToProto(user)}, nil
 }
 
+// GetUser returns a user's profile. Patrons can only see their own; staff
+// can see anyone's.
 func (s *UserService) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
 	objectID, err := primitive.ObjectIDFromHex(req.Id)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
 	}
 
+	caller, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if objectID != caller && !callerCan(ctx, utils.PermLoansManage) {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot view another user's profile")
+	}
+
 	var user models.User
 	err = s.db.Collection("users").FindOne(ctx, bson.M{"_id": objectID}).Decode(&user)
 	if err != nil {
@@ -58,40 +126,746 @@ func (s *UserService) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.
 		return nil, status.Errorf(codes.Internal, "failed to fetch user")
 	}
 
-	return &pb.GetUserResponse{
-		User: &pb.User{
-			Id:       user.ID.Hex(),
-			Username: user.Username,
-			Password: user.Password,
-		},
-	}, nil
+	return &pb.GetUserResponse{User: userToProto(user)}, nil
 }
 
-func (s *UserService) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+// UpdateUser changes the fields set in the request. Users can edit their own
+// profile; only admins can edit other users or change memberships.
+func (s *UserService) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
+	objectID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+	}
+
+	caller, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if objectID != caller || req.MembershipType != nil || req.MembershipExpiresAt != nil {
+		if _, err := RequireAdmin(ctx, s.db); err != nil {
+			return nil, err
+		}
+	}
+
+	var current models.User
+	err = s.db.Collection("users").FindOne(ctx, bson.M{"_id": objectID}).Decode(&current)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to fetch user")
+	}
+
+	var violations fieldViolations
+	set, unset := bson.M{}, bson.M{}
+	setOrUnset := func(field, value string) {
+		if value == "" {
+			unset[field] = ""
+		} else {
+			set[field] = value
+		}
+	}
+
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		validateDisplayName(&violations, "display_name", name)
+		setOrUnset("display_name", name)
+	}
+	if req.Phone != nil {
+		phone := strings.TrimSpace(*req.Phone)
+		validatePhone(&violations, "phone", phone)
+		setOrUnset("phone", phone)
+	}
+
+	emailChanged := false
+	if req.Email != nil {
+		email, err := normalizeEmail(*req.Email)
+		if err != nil {
+			violations.add("email", "invalid email address")
+		} else if email != current.Email {
+			// A new address has to be verified again.
+			emailChanged = true
+			setOrUnset("email", email)
+			unset["email_verified"] = ""
+		}
+	}
+
+	if req.MembershipType != nil {
+		validateMembershipType(&violations, "membership_type", *req.MembershipType)
+		set["membership_type"] = *req.MembershipType
+	}
+	if req.MembershipExpiresAt != nil {
+		if *req.MembershipExpiresAt == "" {
+			unset["membership_expires_at"] = ""
+		} else if expiresAt, err := time.Parse(time.RFC3339, *req.MembershipExpiresAt); err != nil {
+			violations.add("membership_expires_at", "membership expiry must be an RFC3339 timestamp")
+		} else {
+			set["membership_expires_at"] = expiresAt
+		}
+	}
+
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return &pb.UpdateUserResponse{User: userToProto(current)}, nil
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
 	var user models.User
-	err := s.db.Collection("users").FindOne(ctx, bson.M{
-		"username": req.Username,
-		"password": req.Password,
-	}).Decode(&user)
+	err = s.db.Collection("users").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": objectID},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, status.Errorf(codes.AlreadyExists, "email is already registered")
+		}
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to update user")
+	}
+
+	if emailChanged && user.Email != "" {
+		if err := s.sendVerificationEmail(ctx, user); err != nil {
+			log.Printf("Error sending verification email to user %s: %v", user.ID.Hex(), err)
+		}
+	}
+
+	return &pb.UpdateUserResponse{User: userToProto(user)}, nil
+}
 
+// ChangePassword replaces the caller's password after checking the current
+// one, and logs out the caller's other sessions. Wrong guesses count as
+// failed logins, so a stolen token cannot be used to find the password.
+func (s *UserService) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	identity, ok := utils.IdentityFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+	userID, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	err = s.db.Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, status.Errorf(codes.NotFound, "invalid credentials")
+			return nil, status.Errorf(codes.NotFound, "user not found")
 		}
+		return nil, status.Errorf(codes.Internal, "failed to fetch user")
+	}
+
+	userKey := usernameThrottleKey(user.Username)
+	if err := checkLoginThrottle(ctx, s.db, userKey, usernameThrottle); err != nil {
+		return nil, err
+	}
+	if !utils.CheckPassword(user.Password, req.CurrentPassword) {
+		if err := recordLoginFailure(ctx, s.db, userKey, usernameThrottle); err != nil {
+			log.Printf("Error recording failed login for %s: %v", userKey, err)
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "current password is incorrect")
+	}
+
+	var violations fieldViolations
+	validatePassword(&violations, "new_password", req.NewPassword, user.Username)
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	hash, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to hash password")
+	}
+
+	_, err = s.db.Collection("users").UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"password": hash}})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update password")
+	}
+
+	filter := bson.M{"user_id": userID, "revoked_at": nil}
+	if sessionID, err := primitive.ObjectIDFromHex(identity.SessionID); err == nil {
+		filter["_id"] = bson.M{"$ne": sessionID}
+	}
+	_, err = s.db.Collection("sessions").UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke sessions")
+	}
+
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+// DeleteUser removes an account that has no books on loan and no unpaid
+// fines. Its holds are cancelled and its sessions revoked; loan and fine
+// history is kept. Users can delete their own account, admins anyone's.
+func (s *UserService) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	objectID, err := primitive.ObjectIDFromHex(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+	}
+
+	caller, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if objectID != caller {
+		if _, err := RequireAdmin(ctx, s.db); err != nil {
+			return nil, err
+		}
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		var user models.User
+		err := s.db.Collection("users").FindOne(ctx, bson.M{"_id": objectID}).Decode(&user)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.NotFound, "user not found")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to fetch user")
+		}
+
+		loans, err := s.db.Collection("borrowed_books").CountDocuments(ctx, bson.M{"user_id": objectID, "return_date": nil})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check loans")
+		}
+		if loans > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "user still has %d books on loan", loans)
+		}
+
+		balance, err := fineBalance(ctx, s.db, objectID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to compute balance")
+		}
+		if balance > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "user has an outstanding fine balance of %d", balance)
+		}
+
+		cursor, err := s.db.Collection("holds").Find(ctx, bson.M{
+			"user_id": objectID,
+			"status":  bson.M{"$in": bson.A{models.HoldStatusWaiting, models.HoldStatusReady}},
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to fetch holds")
+		}
+		var holds []models.Hold
+		if err := cursor.All(ctx, &holds); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to decode holds")
+		}
+		for _, hold := range holds {
+			_, err := s.db.Collection("holds").UpdateOne(ctx, bson.M{"_id": hold.ID}, bson.M{
+				"$set": bson.M{"status": models.HoldStatusCancelled},
+			})
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to cancel holds")
+			}
+			if hold.Status == models.HoldStatusReady {
+				if err := advanceHoldQueue(ctx, s.db, hold.BookID, hold.ItemID); err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to advance hold queue")
+				}
+			}
+		}
+
+		if _, err := s.db.Collection("users").DeleteOne(ctx, bson.M{"_id": objectID}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete user")
+		}
+		_, err = s.db.Collection("sessions").UpdateMany(
+			ctx,
+			bson.M{"user_id": objectID, "revoked_at": nil},
+			bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to revoke sessions")
+		}
+		if _, err := s.db.Collection("user_tokens").DeleteMany(ctx, bson.M{"user_id": objectID}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete tokens")
+		}
+
+		return user.Username, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := clearLoginFailures(ctx, s.db, usernameThrottleKey(result.(string))); err != nil {
+		log.Printf("Error clearing failed logins for deleted user %s: %v", req.Id, err)
+	}
+
+	return &pb.DeleteUserResponse{Id: req.Id}, nil
+}
+
+// ListUsers pages through users in creation order, optionally filtered by
+// role, membership type and a case-insensitive prefix of the username,
+// display name or email. Admin only.
+func (s *UserService) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	if _, err := RequireAdmin(ctx, s.db); err != nil {
+		return nil, err
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultUserPageSize
+	}
+	if pageSize > maxUserPageSize {
+		pageSize = maxUserPageSize
+	}
+
+	filter := bson.M{}
+	if req.Role != "" {
+		if !utils.ValidRole(req.Role) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid role %q", req.Role)
+		}
+		filter["role"] = req.Role
+		// Users created before roles existed are patrons.
+		if req.Role == models.RolePatron {
+			filter["role"] = bson.M{"$in": bson.A{models.RolePatron, "", nil}}
+		}
+	}
+	if req.MembershipType != "" {
+		filter["membership_type"] = req.MembershipType
+		if req.MembershipType == models.MembershipStandard {
+			filter["membership_type"] = bson.M{"$in": bson.A{models.MembershipStandard, "", nil}}
+		}
+	}
+	if query := strings.TrimSpace(req.Query); query != "" {
+		pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query), Options: "i"}
+		filter["$or"] = bson.A{
+			bson.M{"username": pattern},
+			bson.M{"display_name": pattern},
+			bson.M{"email": pattern},
+		}
+	}
+	if req.PageToken != "" {
+		after, err := decodeUserPageToken(req.PageToken)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+		}
+		filter["_id"] = bson.M{"$gt": after}
+	}
+
+	// Fetch one extra document to find out whether another page exists.
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(pageSize + 1))
+	cursor, err := s.db.Collection("users").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list users")
+	}
+
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode users")
+	}
+
+	resp := &pb.ListUsersResponse{}
+	if len(users) > pageSize {
+		users = users[:pageSize]
+		resp.NextPageToken = encodeUserPageToken(users[len(users)-1].ID)
+	}
+	for _, user := range users {
+		resp.Users = append(resp.Users, userToProto(user))
+	}
+
+	return resp, nil
+}
+
+// Login checks a username and password and starts a session. Failed
+// attempts are counted per username and per client IP; repeated failures
+// are slowed down with ResourceExhausted and eventually lock the account
+// with PermissionDenied.
+func (s *UserService) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+	userKey := usernameThrottleKey(req.Username)
+	// Without a gateway secret every login through the REST API comes from
+	// the gateway's address, and throttling it would lock out everyone at
+	// once, so only usernames are throttled.
+	ipThrottled := s.gatewaySecret != ""
+	ipKey := clientIPThrottleKey(clientIP(ctx, s.gatewaySecret))
+	if ipThrottled {
+		if err := checkLoginThrottle(ctx, s.db, ipKey, clientIPThrottle); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkLoginThrottle(ctx, s.db, userKey, usernameThrottle); err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	err := s.db.Collection("users").FindOne(ctx, bson.M{"username": req.Username}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
 		return nil, status.Errorf(codes.Internal, "failed to authenticate")
 	}
 
-	// Generate JWT token
-	token, err := utils.GenerateToken(user.ID.Hex())
+	if err == mongo.ErrNoDocuments || !utils.CheckPassword(user.Password, req.Password) {
+		if err := recordLoginFailure(ctx, s.db, userKey, usernameThrottle); err != nil {
+			log.Printf("Error recording failed login for %s: %v", userKey, err)
+		}
+		if ipThrottled {
+			if err := recordLoginFailure(ctx, s.db, ipKey, clientIPThrottle); err != nil {
+				log.Printf("Error recording failed login for %s: %v", ipKey, err)
+			}
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "invalid credentials")
+	}
+
+	if err := clearLoginFailures(ctx, s.db, userKey); err != nil {
+		log.Printf("Error clearing failed logins for %s: %v", userKey, err)
+	}
+
+	// Upgrade legacy plaintext passwords to a hash on successful login
+	if !utils.IsPasswordHash(user.Password) {
+		hash, err := utils.HashPassword(req.Password)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to hash password")
+		}
+		_, err = s.db.Collection("users").UpdateOne(
+			ctx,
+			bson.M{"_id": user.ID, "password": user.Password},
+			bson.M{"$set": bson.M{"password": hash}},
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to upgrade password")
+		}
+	}
+
+	tokens, err := startSession(ctx, s.db, user)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to generate token")
+		return nil, status.Errorf(codes.Internal, "failed to start session")
 	}
 
 	return &pb.LoginResponse{
-		Token: token,
-		User: &pb.User{
-			Id:       user.ID.Hex(),
-			Username: user.Username,
-		},
+		Token:        tokens.AccessToken,
+		User:         userToProto(user),
+		RefreshToken: tokens.RefreshToken,
+		ExpiresAt:    tokens.ExpiresAt.Format(time.RFC3339),
 	}, nil
 }
+
+// RequestPasswordReset mails a password reset token to the owner of a
+// verified email address. It succeeds whether or not the address is known,
+// so it cannot be used to find out who has an account.
+func (s *UserService) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	if email == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "email is required")
+	}
+
+	var user models.User
+	err = s.db.Collection("users").FindOne(ctx, bson.M{"email": email, "email_verified": true}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return &pb.RequestPasswordResetResponse{}, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fetch user")
+	}
+
+	token, err := issueUserToken(ctx, s.db, user, models.UserTokenPasswordReset, PasswordResetTokenExpiry)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create reset token")
+	}
+
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password of your account. To choose a new password, send this token with your new password to %s/password/reset:\n\n%s\n\nThe token expires in %s. If you did not ask for this, you can ignore this email.\n",
+			user.Username, s.appURL, token, PasswordResetTokenExpiry,
+		),
+	})
+	if err != nil {
+		log.Printf("Error sending password reset email to user %s: %v", user.ID.Hex(), err)
+	}
+
+	return &pb.RequestPasswordResetResponse{}, nil
+}
+
+// ResetPassword sets a new password using a token from RequestPasswordReset.
+// Every session of the user is revoked, so a stolen login stops working too.
+func (s *UserService) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error) {
+	var violations fieldViolations
+	validatePassword(&violations, "new_password", req.NewPassword, "")
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	hash, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to hash password")
+	}
+
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start transaction")
+	}
+	defer session.EndSession(ctx)
+
+	userID, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		token, err := consumeUserToken(ctx, s.db, req.Token, models.UserTokenPasswordReset)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid or expired reset token")
+			}
+			return nil, status.Errorf(codes.Internal, "failed to check reset token")
+		}
+
+		result, err := s.db.Collection("users").UpdateOne(
+			ctx,
+			bson.M{"_id": token.UserID, "email": token.Email},
+			bson.M{"$set": bson.M{"password": hash}},
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to update password")
+		}
+		if result.MatchedCount == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid or expired reset token")
+		}
+
+		_, err = s.db.Collection("sessions").UpdateMany(
+			ctx,
+			bson.M{"user_id": token.UserID, "revoked_at": nil},
+			bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+		)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to revoke sessions")
+		}
+
+		return token.UserID, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Proving control of the email address also lifts a lockout.
+	var user models.User
+	if err := s.db.Collection("users").FindOne(ctx, bson.M{"_id": userID.(primitive.ObjectID)}).Decode(&user); err == nil {
+		if err := clearLoginFailures(ctx, s.db, usernameThrottleKey(user.Username)); err != nil {
+			log.Printf("Error clearing failed logins for user %s: %v", user.ID.Hex(), err)
+		}
+	}
+
+	return &pb.ResetPasswordResponse{}, nil
+}
+
+// VerifyEmail confirms a user's email address using a token mailed to it.
+func (s *UserService) VerifyEmail(ctx context.Context, req *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+	token, err := consumeUserToken(ctx, s.db, req.Token, models.UserTokenEmailVerification)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid or expired verification token")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to check verification token")
+	}
+
+	// The token only verifies the address it was sent to.
+	var user models.User
+	err = s.db.Collection("users").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": token.UserID, "email": token.Email},
+		bson.M{"$set": bson.M{"email_verified": true}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.FailedPrecondition, "email address has changed since the token was sent")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to verify email")
+	}
+
+	return &pb.VerifyEmailResponse{User: userToProto(user)}, nil
+}
+
+func (s *UserService) sendVerificationEmail(ctx context.Context, user models.User) error {
+	token, err := issueUserToken(ctx, s.db, user, models.UserTokenEmailVerification, EmailVerificationTokenExpiry)
+	if err != nil {
+		return err
+	}
+
+	link := s.appURL + "/email/verify?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\nThe link expires in %s.\n",
+			user.Username, link, EmailVerificationTokenExpiry,
+		),
+	})
+}
+
+// UnlockUser lifts a login lockout and forgets the user's failed logins.
+func (s *UserService) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	if _, err := RequireAdmin(ctx, s.db); err != nil {
+		return nil, err
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+	}
+
+	var user models.User
+	err = s.db.Collection("users").FindOne(ctx, bson.M{"_id": objectID}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to fetch user")
+	}
+
+	if err := clearLoginFailures(ctx, s.db, usernameThrottleKey(user.Username)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unlock user")
+	}
+
+	return &pb.UnlockUserResponse{User: userToProto(user)}, nil
+}
+
+func (s *UserService) GrantRole(ctx context.Context, req *pb.GrantRoleRequest) (*pb.GrantRoleResponse, error) {
+	if _, err := RequireAdmin(ctx, s.db); err != nil {
+		return nil, err
+	}
+
+	if !utils.ValidRole(req.Role) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid role %q", req.Role)
+	}
+
+	user, err := s.setRole(ctx, req.UserId, bson.M{}, req.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GrantRoleResponse{User: userToProto(*user)}, nil
+}
+
+// RevokeRole takes a role away from a user, leaving them a patron.
+func (s *UserService) RevokeRole(ctx context.Context, req *pb.RevokeRoleRequest) (*pb.RevokeRoleResponse, error) {
+	adminID, err := RequireAdmin(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Role == models.RolePatron || !utils.ValidRole(req.Role) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid role %q", req.Role)
+	}
+	if req.UserId == adminID.Hex() && req.Role == models.RoleAdmin {
+		return nil, status.Errorf(codes.FailedPrecondition, "admins cannot revoke their own admin role")
+	}
+
+	user, err := s.setRole(ctx, req.UserId, bson.M{"role": req.Role}, models.RolePatron)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, status.Errorf(codes.FailedPrecondition, "user does not have role %q", req.Role)
+		}
+		return nil, err
+	}
+
+	return &pb.RevokeRoleResponse{User: userToProto(*user)}, nil
+}
+
+func (s *UserService) setRole(ctx context.Context, id string, filter bson.M, role string) (*models.User, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid user ID")
+	}
+	filter["_id"] = objectID
+
+	var user models.User
+	err = s.db.Collection("users").FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$set": bson.M{"role": role}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to update role")
+	}
+
+	return &user, nil
+}
+
+// userRole returns the user's role, treating users created before roles
+// existed as patrons.
+func userRole(user models.User) string {
+	if user.Role == "" {
+		return models.RolePatron
+	}
+	return user.Role
+}
+
+// userMembershipType treats users created before memberships existed as
+// standard members.
+func userMembershipType(user models.User) string {
+	if user.MembershipType == "" {
+		return models.MembershipStandard
+	}
+	return user.MembershipType
+}
+
+func userToProto(user models.User) *pb.User {
+	resp := &pb.User{
+		Id:             user.ID.Hex(),
+		Username:       user.Username,
+		Role:           userRole(user),
+		Email:          user.Email,
+		EmailVerified:  user.EmailVerified,
+		DisplayName:    user.DisplayName,
+		Phone:          user.Phone,
+		MembershipType: userMembershipType(user),
+	}
+	if user.MembershipExpiresAt != nil {
+		resp.MembershipExpiresAt = user.MembershipExpiresAt.Format(time.RFC3339)
+	}
+	if !user.CreatedAt.IsZero() {
+		resp.CreatedAt = user.CreatedAt.Format(time.RFC3339)
+	}
+	return resp
+}
+
+func encodeUserPageToken(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+func decodeUserPageToken(s string) (primitive.ObjectID, error) {
+	var id primitive.ObjectID
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(data) != len(id) {
+		return id, fmt.Errorf("invalid page token length %d", len(data))
+	}
+	copy(id[:], data)
+	return id, nil
+}
+
+// normalizeEmail validates an email address and lower-cases it so lookups
+// are case-insensitive. An empty address is allowed.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", status.Errorf(codes.InvalidArgument, "invalid email address")
+	}
+	return strings.ToLower(email), nil
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"gc-buku/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// PasswordResetTokenExpiry is how long a password reset link is valid.
+	PasswordResetTokenExpiry = time.Hour
+	// EmailVerificationTokenExpiry is how long an email verification link is
+	// valid.
+	EmailVerificationTokenExpiry = 48 * time.Hour
+)
+
+// issueUserToken stores a new single-use token for user and returns it. The
+// token is bound to the user's current email address.
+func issueUserToken(ctx context.Context, db *mongo.Database, user models.User, purpose string, expiry time.Duration) (string, error) {
+	token, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = db.Collection("user_tokens").InsertOne(ctx, models.UserToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: hashSecretToken(token),
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(expiry),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeUserToken marks an unused, unexpired token as used and returns it.
+// It returns mongo.ErrNoDocuments when there is no such token.
+func consumeUserToken(ctx context.Context, db *mongo.Database, token, purpose string) (*models.UserToken, error) {
+	now := time.Now()
+	var userToken models.UserToken
+	err := db.Collection("user_tokens").FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"token_hash": hashSecretToken(token),
+			"purpose":    purpose,
+			"used_at":    nil,
+			"expires_at": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"used_at": now}},
+	).Decode(&userToken)
+	if err != nil {
+		return nil, err
+	}
+	return &userToken, nil
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"gc-buku/models"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+
+	minPasswordLength = 8
+	// bcrypt ignores everything after the first 72 bytes.
+	maxPasswordLength = 72
+
+	maxDisplayNameLength = 100
+
+	maxBarcodeLength  = 32
+	maxLocationLength = 100
+
+	maxAuthorNameLength = 200
+
+	maxSubjectNameLength = 100
+	maxTagLength         = 50
+	maxTags              = 20
+
+	maxExternalIDLength = 100
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	phonePattern    = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{5,19}$`)
+	barcodePattern  = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+	// deweyPattern accepts a class number with optional decimals and cutter,
+	// such as "823.914 ORW".
+	deweyPattern = regexp.MustCompile(`^[0-9]{3}(\.[0-9]+)?( [A-Za-z0-9.]+)*$`)
+	// lccPattern accepts a class, number and optional cutters and year, such
+	// as "PR6029.R8 N49 1949".
+	lccPattern = regexp.MustCompile(`^[A-Z]{1,3} ?[0-9]{1,4}(\.[0-9]+)?( ?\.?[A-Za-z0-9]+)*$`)
+)
+
+// fieldViolations collects validation failures for a request.
+type fieldViolations []*errdetails.BadRequest_FieldViolation
+
+func (v *fieldViolations) add(field, description string) {
+	*v = append(*v, &errdetails.BadRequest_FieldViolation{Field: field, Description: description})
+}
+
+// err returns an InvalidArgument status carrying the violations as a
+// BadRequest detail, or nil if there are none.
+func (v fieldViolations) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	st := status.New(codes.InvalidArgument, "invalid request: "+v[0].Description)
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: v})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func validateUsername(v *fieldViolations, field, username string) {
+	switch {
+	case len(username) < minUsernameLength || len(username) > maxUsernameLength:
+		v.add(field, "username must be between 3 and 32 characters")
+	case !usernamePattern.MatchString(username):
+		v.add(field, "username may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit")
+	}
+}
+
+// validatePassword applies the password policy: 8 to 72 characters, at least
+// one letter and one digit, and not containing the username.
+func validatePassword(v *fieldViolations, field, password, username string) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		v.add(field, "password must be between 8 and 72 characters")
+		return
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		v.add(field, "password must contain at least one letter and one digit")
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		v.add(field, "password must not contain the username")
+	}
+}
+
+func validateDisplayName(v *fieldViolations, field, name string) {
+	if len(name) > maxDisplayNameLength {
+		v.add(field, "display name must be at most 100 characters")
+	}
+}
+
+func validatePhone(v *fieldViolations, field, phone string) {
+	if phone != "" && !phonePattern.MatchString(phone) {
+		v.add(field, "phone must be 6 to 20 digits, optionally starting with '+' and using spaces, '-' or parentheses")
+	}
+}
+
+func validateMembershipType(v *fieldViolations, field, membershipType string) {
+	switch membershipType {
+	case models.MembershipStandard, models.MembershipStudent, models.MembershipStaff:
+	default:
+		v.add(field, "membership type must be standard, student or staff")
+	}
+}
+
+func validateBarcode(v *fieldViolations, field, barcode string) {
+	switch {
+	case len(barcode) > maxBarcodeLength:
+		v.add(field, "barcode must be at most 32 characters")
+	case !barcodePattern.MatchString(barcode):
+		v.add(field, "barcode may only contain letters, digits and '-'")
+	}
+}
+
+func validateLocation(v *fieldViolations, field, location string) {
+	if len(location) > maxLocationLength {
+		v.add(field, "location must be at most 100 characters")
+	}
+}
+
+func validateItemCondition(v *fieldViolations, field, condition string) {
+	switch condition {
+	case models.ItemConditionNew, models.ItemConditionGood, models.ItemConditionFair,
+		models.ItemConditionPoor, models.ItemConditionDamaged:
+	default:
+		v.add(field, "condition must be one of new, good, fair, poor or damaged")
+	}
+}
+
+func validateAuthorName(v *fieldViolations, field, name string) {
+	switch {
+	case name == "":
+		v.add(field, "name is required")
+	case len(name) > maxAuthorNameLength:
+		v.add(field, "name must be at most 200 characters")
+	}
+}
+
+func validateContributorRole(v *fieldViolations, field, role string) {
+	switch role {
+	case "", models.ContributorRoleAuthor, models.ContributorRoleEditor, models.ContributorRoleTranslator:
+	default:
+		v.add(field, "role must be author, editor or translator")
+	}
+}
+
+func validateSubjectName(v *fieldViolations, field, name string) {
+	switch {
+	case name == "":
+		v.add(field, "name is required")
+	case len(name) > maxSubjectNameLength:
+		v.add(field, "name must be at most 100 characters")
+	}
+}
+
+// normalizeTags lowercases and trims tags and drops blanks and duplicates.
+func normalizeTags(v *fieldViolations, field string, tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			v.add(field, "tags must be at most 50 characters")
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		v.add(field, "a book can have at most 20 tags")
+	}
+	return normalized
+}
+
+func validateDewey(v *fieldViolations, field, dewey string) {
+	if dewey != "" && !deweyPattern.MatchString(dewey) {
+		v.add(field, "dewey must be a class number such as 823.914")
+	}
+}
+
+func validateLCC(v *fieldViolations, field, lcc string) {
+	if lcc != "" && !lccPattern.MatchString(lcc) {
+		v.add(field, "lcc must be a call number such as PR6029.R8 N49")
+	}
+}
+
+func validateExternalID(v *fieldViolations, field, id string) {
+	if len(id) > maxExternalIDLength {
+		v.add(field, "external ID must be at most 100 characters")
+	}
+}
+
+// publishedDateLayouts are the forms a published date may be given in.
+var publishedDateLayouts = []string{time.RFC3339, "2006-01-02", "2006"}
+
+// parsePublishedDate parses a date given as RFC3339, YYYY-MM-DD or just the
+// year. It returns the zero time for "".
+func parsePublishedDate(v *fieldViolations, field, date string) time.Time {
+	if date == "" {
+		return time.Time{}
+	}
+	for _, layout := range publishedDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	v.add(field, "published date must be RFC3339, YYYY-MM-DD or YYYY")
+	return time.Time{}
+}
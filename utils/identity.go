@@ -0,0 +1,26 @@
+package utils
+
+import "context"
+
+// Identity is the authenticated caller of a gRPC method.
+type Identity struct {
+	UserID    string
+	Role      string
+	SessionID string
+}
+
+// GatewaySecretMetadata is the metadata key the REST gateway sends the
+// secret it shares with the gRPC server in, to vouch for the client
+// address it forwards as x-forwarded-for.
+const GatewaySecretMetadata = "x-gateway-secret"
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrISBNLength   = errors.New("ISBN must have 10 or 13 digits")
+	ErrISBNChecksum = errors.New("ISBN check digit is wrong")
+	ErrISBNPrefix   = errors.New("ISBN-13 must start with 978 or 979")
+)
+
+// NormalizeISBN validates an ISBN-10 or ISBN-13, ignoring spaces and hyphens,
+// and returns it as a bare ISBN-13. ISBN-10s are converted by prefixing 978.
+func NormalizeISBN(isbn string) (string, error) {
+	isbn = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(isbn))
+
+	switch len(isbn) {
+	case 10:
+		if !isDigits(isbn[:9]) || !(isDigits(isbn[9:]) || isbn[9] == 'X') {
+			return "", ErrISBNLength
+		}
+		if isbn10CheckDigit(isbn[:9]) != isbn[9] {
+			return "", ErrISBNChecksum
+		}
+		body := "978" + isbn[:9]
+		return body + string(isbn13CheckDigit(body)), nil
+	case 13:
+		if !isDigits(isbn) {
+			return "", ErrISBNLength
+		}
+		if !strings.HasPrefix(isbn, "978") && !strings.HasPrefix(isbn, "979") {
+			return "", ErrISBNPrefix
+		}
+		if isbn13CheckDigit(isbn[:12]) != isbn[12] {
+			return "", ErrISBNChecksum
+		}
+		return isbn, nil
+	default:
+		return "", ErrISBNLength
+	}
+}
+
+// ISBN10 returns the ISBN-10 form of a normalized ISBN-13, or "" for 979
+// ISBNs, which have none.
+func ISBN10(isbn13 string) string {
+	if len(isbn13) != 13 || !strings.HasPrefix(isbn13, "978") {
+		return ""
+	}
+	body := isbn13[3:12]
+	return body + string(isbn10CheckDigit(body))
+}
+
+// isbn10CheckDigit computes the check digit for the first nine digits of an
+// ISBN-10: weights 10 down to 2, modulo 11, with 10 written as X.
+func isbn10CheckDigit(body string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(body[i]-'0') * (10 - i)
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// isbn13CheckDigit computes the check digit for the first twelve digits of an
+// ISBN-13: alternating weights 1 and 3, modulo 10.
+func isbn13CheckDigit(body string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(body[i]-'0') * weight
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
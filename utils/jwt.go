@@ -1,37 +1,145 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
-var jwtSecret = []byte("your-secret-key")
+// legacySecret is the HS256 secret used when no key is configured, so local
+// setups keep working. Never rely on it in production.
+const legacySecret = "your-secret-key"
+
+var jwtConfig = JWTConfig{
+	Keys: map[string]*JWTKey{
+		"": {
+			Method:    jwt.SigningMethodHS256,
+			SignKey:   []byte(legacySecret),
+			VerifyKey: []byte(legacySecret),
+		},
+	},
+	Expiry:        15 * time.Minute,
+	RefreshExpiry: 30 * 24 * time.Hour,
+}
+
+// JWTConfig controls how tokens are signed and validated.
+type JWTConfig struct {
+	// Keys are the keys tokens may be verified with, by kid.
+	Keys map[string]*JWTKey
+	// ActiveKey is the kid new tokens are signed with.
+	ActiveKey string
+	Issuer    string
+	Audience  string
+	// Expiry is the lifetime of access tokens.
+	Expiry time.Duration
+	// RefreshExpiry is the lifetime of refresh tokens and their sessions.
+	RefreshExpiry time.Duration
+}
+
+// JWTKey is a single signing key. Asymmetric keys without private material
+// can only verify tokens.
+type JWTKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	SignKey   interface{}
+	VerifyKey interface{}
+}
 
 type Claims struct {
-	UserID string `json:"user_id"`
+	UserID    string `json:"user_id"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
 	jwt.StandardClaims
 }
 
-func GenerateToken(userID string) (string, error) {
+// ConfigureJWT replaces the token configuration.
+func ConfigureJWT(cfg JWTConfig) error {
+	if cfg.Expiry <= 0 || cfg.RefreshExpiry <= 0 {
+		return errors.New("jwt expiry must be positive")
+	}
+	if len(cfg.Keys) == 0 {
+		return errors.New("no jwt keys configured")
+	}
+	if cfg.ActiveKey != "" {
+		if _, ok := cfg.Keys[cfg.ActiveKey]; !ok {
+			return fmt.Errorf("active jwt key %q not found", cfg.ActiveKey)
+		}
+	}
+	jwtConfig = cfg
+	return nil
+}
+
+// RefreshTokenExpiry is how long refresh tokens and their sessions last.
+func RefreshTokenExpiry() time.Duration {
+	return jwtConfig.RefreshExpiry
+}
+
+// AccessTokenExpiry is how long access tokens last.
+func AccessTokenExpiry() time.Duration {
+	return jwtConfig.Expiry
+}
+
+func GenerateToken(userID, role, sessionID string) (string, error) {
+	key, ok := jwtConfig.Keys[jwtConfig.ActiveKey]
+	if !ok || key.SignKey == nil {
+		return "", errors.New("no jwt signing key configured")
+	}
+
+	now := time.Now()
 	claims := &Claims{
-		UserID: userID,
+		UserID:    userID,
+		Role:      role,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
+			Issuer:    jwtConfig.Issuer,
+			Audience:  jwtConfig.Audience,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(jwtConfig.Expiry).Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.SignKey)
 }
 
 func ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
+		// Tokens without a kid predate key rotation and use the active key.
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			kid = jwtConfig.ActiveKey
+		}
+
+		key, ok := jwtConfig.Keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		// Refuse tokens whose alg does not match the key, e.g. HS256 tokens
+		// "signed" with an RSA public key.
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return key.VerifyKey, nil
 	})
-	if err != nil || !token.Valid {
+	if err != nil {
 		return nil, err
 	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	if jwtConfig.Issuer != "" && !claims.VerifyIssuer(jwtConfig.Issuer, true) {
+		return nil, errors.New("invalid token issuer")
+	}
+	if jwtConfig.Audience != "" && !claims.VerifyAudience(jwtConfig.Audience, true) {
+		return nil, errors.New("invalid token audience")
+	}
+
 	return claims, nil
 }
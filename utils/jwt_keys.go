@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// jwtKeyFile is the format of the file named by JWT_KEYS_FILE. Key paths are
+// relative to the file. Verify-only deployments, such as the REST client, list
+// public keys without private_key_file.
+//
+//	{
+//	  "active": "2026-10",
+//	  "keys": [
+//	    {"id": "2026-10", "algorithm": "EdDSA", "private_key_file": "ed-2026-10.pem", "public_key_file": "ed-2026-10.pub.pem"},
+//	    {"id": "2026-04", "algorithm": "RS256", "public_key_file": "rs-2026-04.pub.pem"}
+//	  ]
+//	}
+type jwtKeyFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		ID             string `json:"id"`
+		Algorithm      string `json:"algorithm"`
+		Secret         string `json:"secret"`
+		PrivateKeyFile string `json:"private_key_file"`
+		PublicKeyFile  string `json:"public_key_file"`
+	} `json:"keys"`
+}
+
+// ConfigureJWTFromEnv loads the token configuration from the environment:
+//
+//	JWT_KEYS_FILE       key set file, see jwtKeyFile
+//	JWT_SECRET          HS256 secret, used when there is no key file
+//	JWT_ISSUER          issuer set on and required of tokens
+//	JWT_AUDIENCE        audience set on and required of tokens
+//	JWT_EXPIRY          access token lifetime, e.g. "15m"
+//	JWT_REFRESH_EXPIRY  refresh token lifetime, e.g. "720h"
+//
+// Without JWT_KEYS_FILE or JWT_SECRET the legacy built-in secret is kept.
+func ConfigureJWTFromEnv() error {
+	cfg := JWTConfig{
+		Issuer:        os.Getenv("JWT_ISSUER"),
+		Audience:      os.Getenv("JWT_AUDIENCE"),
+		Expiry:        15 * time.Minute,
+		RefreshExpiry: 30 * 24 * time.Hour,
+	}
+
+	if v := os.Getenv("JWT_EXPIRY"); v != "" {
+		expiry, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid JWT_EXPIRY: %v", err)
+		}
+		cfg.Expiry = expiry
+	}
+
+	if v := os.Getenv("JWT_REFRESH_EXPIRY"); v != "" {
+		expiry, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid JWT_REFRESH_EXPIRY: %v", err)
+		}
+		cfg.RefreshExpiry = expiry
+	}
+
+	switch {
+	case os.Getenv("JWT_KEYS_FILE") != "":
+		keys, active, err := loadJWTKeyFile(os.Getenv("JWT_KEYS_FILE"))
+		if err != nil {
+			return err
+		}
+		cfg.Keys, cfg.ActiveKey = keys, active
+	case os.Getenv("JWT_SECRET") != "":
+		secret := []byte(os.Getenv("JWT_SECRET"))
+		cfg.Keys = map[string]*JWTKey{"": {Method: jwt.SigningMethodHS256, SignKey: secret, VerifyKey: secret}}
+	default:
+		log.Printf("WARNING: JWT_KEYS_FILE and JWT_SECRET are not set, using the built-in development secret")
+		cfg.Keys, cfg.ActiveKey = jwtConfig.Keys, jwtConfig.ActiveKey
+	}
+
+	return ConfigureJWT(cfg)
+}
+
+func loadJWTKeyFile(path string) (map[string]*JWTKey, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read jwt key file: %v", err)
+	}
+
+	var file jwtKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, "", fmt.Errorf("failed to parse jwt key file: %v", err)
+	}
+
+	dir := filepath.Dir(path)
+	readPEM := func(name string) ([]byte, error) {
+		if name == "" {
+			return nil, nil
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+
+	keys := make(map[string]*JWTKey, len(file.Keys))
+	for _, k := range file.Keys {
+		if k.ID == "" {
+			return nil, "", fmt.Errorf("jwt key without id")
+		}
+		if _, ok := keys[k.ID]; ok {
+			return nil, "", fmt.Errorf("duplicate jwt key %q", k.ID)
+		}
+
+		privatePEM, err := readPEM(k.PrivateKeyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("jwt key %q: %v", k.ID, err)
+		}
+		publicPEM, err := readPEM(k.PublicKeyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("jwt key %q: %v", k.ID, err)
+		}
+
+		key, err := parseJWTKey(k.Algorithm, k.Secret, privatePEM, publicPEM)
+		if err != nil {
+			return nil, "", fmt.Errorf("jwt key %q: %v", k.ID, err)
+		}
+		key.ID = k.ID
+		keys[k.ID] = key
+	}
+
+	if _, ok := keys[file.Active]; !ok {
+		return nil, "", fmt.Errorf("active jwt key %q not found", file.Active)
+	}
+
+	return keys, file.Active, nil
+}
+
+func parseJWTKey(alg, secret string, privatePEM, publicPEM []byte) (*JWTKey, error) {
+	key := &JWTKey{}
+
+	switch alg {
+	case "HS256":
+		if secret == "" {
+			return nil, fmt.Errorf("HS256 requires a secret")
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.SignKey, key.VerifyKey = []byte(secret), []byte(secret)
+		return key, nil
+
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		if privatePEM != nil {
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, err
+			}
+			key.SignKey, key.VerifyKey = private, &private.PublicKey
+		}
+		if publicPEM != nil {
+			public, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, err
+			}
+			key.VerifyKey = public
+		}
+
+	case "EdDSA":
+		key.Method = jwt.SigningMethodEdDSA
+		if privatePEM != nil {
+			private, err := jwt.ParseEdPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, err
+			}
+			key.SignKey, key.VerifyKey = private, private.(crypto.Signer).Public()
+		}
+		if publicPEM != nil {
+			public, err := jwt.ParseEdPublicKeyFromPEM(publicPEM)
+			if err != nil {
+				return nil, err
+			}
+			key.VerifyKey = public
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	if key.VerifyKey == nil {
+		return nil, fmt.Errorf("%s requires a public key", alg)
+	}
+	return key, nil
+}
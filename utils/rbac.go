@@ -0,0 +1,63 @@
+package utils
+
+import "gc-buku/models"
+
+const (
+	PermBooksRead   = "books:read"
+	PermBooksWrite  = "books:write"
+	PermCirculation = "circulation"
+	PermLoansManage = "loans:manage"
+	PermUsersRead   = "users:read"
+	PermUsersManage = "users:manage"
+	PermFinesManage = "fines:manage"
+	PermFinesWaive  = "fines:waive"
+	PermRolesManage = "roles:manage"
+	PermJobsView    = "jobs:view"
+)
+
+var patronPermissions = []string{
+	PermBooksRead,
+	PermCirculation,
+	PermUsersRead,
+}
+
+var librarianPermissions = append([]string{
+	PermBooksWrite,
+	PermLoansManage,
+	PermFinesManage,
+}, patronPermissions...)
+
+var adminPermissions = append([]string{
+	PermFinesWaive,
+	PermRolesManage,
+	PermJobsView,
+	PermUsersManage,
+}, librarianPermissions...)
+
+// RolePermissions is the permission matrix shared by the REST gateway and the
+// gRPC server.
+var RolePermissions = map[string][]string{
+	models.RolePatron:    patronPermissions,
+	models.RoleLibrarian: librarianPermissions,
+	models.RoleAdmin:     adminPermissions,
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether role grants perm. Users created before roles
+// existed have no role and are treated as patrons.
+func HasPermission(role, perm string) bool {
+	if role == "" {
+		role = models.RolePatron
+	}
+	for _, p := range RolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}